@@ -0,0 +1,290 @@
+package netcode
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ban list of client ids, IP addresses and CIDR ranges checked by the server when
+// connection requests arrive. All methods are safe to call from any goroutine, changes
+// are applied to connected clients on the server's next Update.
+type AccessList struct {
+	mutex     sync.RWMutex
+	clientIds map[uint64]int64   // client id -> unix expire time, 0 never expires
+	addresses map[[16]byte]int64 // ip -> unix expire time, 0 never expires
+	networks  map[string]*accessNetwork
+	version   uint64 // incremented on every change
+	clock     Clock  // bans expire by this clock
+}
+
+type accessNetwork struct {
+	network *net.IPNet
+	expires int64
+}
+
+// the persisted form of the list, expires is a unix timestamp with 0 meaning never.
+type accessListJSON struct {
+	ClientIds []accessEntryJSON `json:"client_ids"`
+	Addresses []accessEntryJSON `json:"addresses"`
+	Networks  []accessEntryJSON `json:"networks"`
+}
+
+type accessEntryJSON struct {
+	ClientId uint64 `json:"client_id,omitempty"`
+	Address  string `json:"address,omitempty"`
+	Network  string `json:"network,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+}
+
+func NewAccessList() *AccessList {
+	a := &AccessList{}
+	a.clientIds = make(map[uint64]int64)
+	a.addresses = make(map[[16]byte]int64)
+	a.networks = make(map[string]*accessNetwork)
+	a.clock = systemClock{}
+	return a
+}
+
+// Sets the clock bans are expired against, nil reverts to the system clock.
+func (a *AccessList) SetClock(clock Clock) {
+	a.mutex.Lock()
+	a.clock = clockOrSystem(clock)
+	a.mutex.Unlock()
+}
+
+// converts the optional expire time to a unix timestamp, the zero time never expires.
+func accessExpires(expires time.Time) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+	return expires.Unix()
+}
+
+func accessExpired(expires, now int64) bool {
+	return expires != 0 && expires <= now
+}
+
+// Bans the client id until expires, the zero time bans it permanently.
+func (a *AccessList) BanClientId(clientId uint64, expires time.Time) {
+	a.mutex.Lock()
+	a.clientIds[clientId] = accessExpires(expires)
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+}
+
+func (a *AccessList) UnbanClientId(clientId uint64) {
+	a.mutex.Lock()
+	delete(a.clientIds, clientId)
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+}
+
+// Bans the IP address until expires, the zero time bans it permanently.
+func (a *AccessList) BanAddress(ip net.IP, expires time.Time) error {
+	if ip.To16() == nil {
+		return errors.New("invalid ip address")
+	}
+	a.mutex.Lock()
+	a.addresses[addressKey(ip)] = accessExpires(expires)
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+	return nil
+}
+
+func (a *AccessList) UnbanAddress(ip net.IP) {
+	a.mutex.Lock()
+	delete(a.addresses, addressKey(ip))
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+}
+
+// Bans the CIDR range, for example "10.0.0.0/8" or "2001:db8::/32", until expires. The zero
+// time bans it permanently.
+func (a *AccessList) BanNetwork(cidr string, expires time.Time) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	a.networks[network.String()] = &accessNetwork{network: network, expires: accessExpires(expires)}
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+	return nil
+}
+
+func (a *AccessList) UnbanNetwork(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	delete(a.networks, network.String())
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+	return nil
+}
+
+// Returns true if the client id is banned and the ban has not expired.
+func (a *AccessList) IsClientIdBanned(clientId uint64) bool {
+	a.mutex.RLock()
+	now := a.clock.Now().Unix()
+	expires, ok := a.clientIds[clientId]
+	a.mutex.RUnlock()
+
+	if ok && accessExpired(expires, now) {
+		a.removeExpired(now)
+		return false
+	}
+	return ok
+}
+
+// Returns true if the address or a network containing it is banned and the ban has not expired.
+func (a *AccessList) IsAddressBanned(ip net.IP) bool {
+	a.mutex.RLock()
+	now := a.clock.Now().Unix()
+	banned := false
+	expired := false
+	if expires, ok := a.addresses[addressKey(ip)]; ok {
+		expired = accessExpired(expires, now)
+		banned = !expired
+	}
+
+	for _, entry := range a.networks {
+		if accessExpired(entry.expires, now) {
+			expired = true
+		} else if entry.network.Contains(ip) {
+			banned = true
+		}
+	}
+	a.mutex.RUnlock()
+
+	if expired {
+		a.removeExpired(now)
+	}
+	return banned
+}
+
+// deletes every ban which has expired by now so lookups and Save no longer see them.
+func (a *AccessList) removeExpired(now int64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for clientId, expires := range a.clientIds {
+		if accessExpired(expires, now) {
+			delete(a.clientIds, clientId)
+		}
+	}
+
+	for key, expires := range a.addresses {
+		if accessExpired(expires, now) {
+			delete(a.addresses, key)
+		}
+	}
+
+	for cidr, entry := range a.networks {
+		if accessExpired(entry.expires, now) {
+			delete(a.networks, cidr)
+		}
+	}
+}
+
+// Returns true if either the client id or address is banned.
+func (a *AccessList) IsBanned(clientId uint64, addr *net.UDPAddr) bool {
+	return a.IsClientIdBanned(clientId) || (addr != nil && a.IsAddressBanned(addr.IP))
+}
+
+// returns a counter which changes every time the list is modified.
+func (a *AccessList) getVersion() uint64 {
+	return atomic.LoadUint64(&a.version)
+}
+
+// Removes expired entries then writes the rest to the file as JSON.
+func (a *AccessList) Save(path string) error {
+	a.mutex.RLock()
+	now := a.clock.Now().Unix()
+	a.mutex.RUnlock()
+	a.removeExpired(now)
+
+	data, err := a.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// Replaces the list with the entries in the JSON file written by Save.
+func (a *AccessList) Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return a.UnmarshalJSON(data)
+}
+
+func (a *AccessList) MarshalJSON() ([]byte, error) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	now := a.clock.Now().Unix()
+	list := &accessListJSON{ClientIds: []accessEntryJSON{}, Addresses: []accessEntryJSON{}, Networks: []accessEntryJSON{}}
+	for clientId, expires := range a.clientIds {
+		if !accessExpired(expires, now) {
+			list.ClientIds = append(list.ClientIds, accessEntryJSON{ClientId: clientId, Expires: expires})
+		}
+	}
+
+	for key, expires := range a.addresses {
+		if !accessExpired(expires, now) {
+			list.Addresses = append(list.Addresses, accessEntryJSON{Address: net.IP(key[:]).String(), Expires: expires})
+		}
+	}
+
+	for cidr, entry := range a.networks {
+		if !accessExpired(entry.expires, now) {
+			list.Networks = append(list.Networks, accessEntryJSON{Network: cidr, Expires: entry.expires})
+		}
+	}
+	return json.MarshalIndent(list, "", "  ")
+}
+
+// Replaces the list with the JSON entries, the list is left unchanged if any entry is invalid.
+func (a *AccessList) UnmarshalJSON(data []byte) error {
+	list := &accessListJSON{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return err
+	}
+
+	loaded := NewAccessList()
+	for _, entry := range list.ClientIds {
+		loaded.clientIds[entry.ClientId] = entry.Expires
+	}
+
+	for _, entry := range list.Addresses {
+		ip := net.ParseIP(entry.Address)
+		if ip == nil {
+			return errors.New("invalid ip address in access list: " + entry.Address)
+		}
+		loaded.addresses[addressKey(ip)] = entry.Expires
+	}
+
+	for _, entry := range list.Networks {
+		_, network, err := net.ParseCIDR(entry.Network)
+		if err != nil {
+			return err
+		}
+		loaded.networks[network.String()] = &accessNetwork{network: network, expires: entry.Expires}
+	}
+
+	a.mutex.Lock()
+	a.clientIds = loaded.clientIds
+	a.addresses = loaded.addresses
+	a.networks = loaded.networks
+	a.mutex.Unlock()
+	atomic.AddUint64(&a.version, 1)
+	return nil
+}
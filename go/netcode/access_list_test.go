@@ -0,0 +1,184 @@
+package netcode
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccessList(t *testing.T) {
+	list := NewAccessList()
+	list.BanClientId(10, time.Time{})
+	list.BanClientId(11, time.Now().Add(-time.Second))
+	if err := list.BanAddress(net.ParseIP("192.168.1.10"), time.Time{}); err != nil {
+		t.Fatalf("error banning address: %s\n", err)
+	}
+
+	if err := list.BanNetwork("10.0.0.0/8", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("error banning network: %s\n", err)
+	}
+
+	if err := list.BanNetwork("not a network", time.Time{}); err == nil {
+		t.Fatalf("expected error banning invalid network\n")
+	}
+
+	if !list.IsClientIdBanned(10) {
+		t.Fatalf("expected client id 10 to be banned\n")
+	}
+
+	if list.IsClientIdBanned(11) {
+		t.Fatalf("expected ban for client id 11 to have expired\n")
+	}
+
+	if !list.IsAddressBanned(net.ParseIP("192.168.1.10")) || list.IsAddressBanned(net.ParseIP("192.168.1.11")) {
+		t.Fatalf("expected only 192.168.1.10 to be banned\n")
+	}
+
+	if !list.IsBanned(1, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}) {
+		t.Fatalf("expected address in banned network to be banned\n")
+	}
+
+	path := filepath.Join(os.TempDir(), "netcode_access_list_test.json")
+	defer os.Remove(path)
+	if err := list.Save(path); err != nil {
+		t.Fatalf("error saving access list: %s\n", err)
+	}
+
+	loaded := NewAccessList()
+	if err := loaded.Load(path); err != nil {
+		t.Fatalf("error loading access list: %s\n", err)
+	}
+
+	if !loaded.IsClientIdBanned(10) || !loaded.IsAddressBanned(net.ParseIP("192.168.1.10")) || !loaded.IsAddressBanned(net.ParseIP("10.255.0.1")) {
+		t.Fatalf("loaded access list is missing entries\n")
+	}
+
+	if len(loaded.clientIds) != 1 {
+		t.Fatalf("expected expired entries to not be saved, got %d client ids\n", len(loaded.clientIds))
+	}
+
+	version := loaded.getVersion()
+	if err := ioutil.WriteFile(path, []byte(`{"addresses": [{"address": "bogus"}]}`), 0644); err != nil {
+		t.Fatalf("error writing file: %s\n", err)
+	}
+
+	if err := loaded.Load(path); err == nil {
+		t.Fatalf("expected error loading invalid access list\n")
+	}
+
+	if loaded.getVersion() != version || !loaded.IsClientIdBanned(10) {
+		t.Fatalf("failed load should leave the access list unchanged\n")
+	}
+
+	loaded.UnbanClientId(10)
+	loaded.UnbanAddress(net.ParseIP("192.168.1.10"))
+	if err := loaded.UnbanNetwork("10.0.0.0/8"); err != nil {
+		t.Fatalf("error unbanning network: %s\n", err)
+	}
+
+	if loaded.IsBanned(10, &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 40000}) {
+		t.Fatalf("expected all bans to be removed\n")
+	}
+}
+
+func TestAccessListRemovesExpired(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	list := NewAccessList()
+	list.SetClock(clock)
+	list.BanClientId(10, clock.Now().Add(time.Minute))
+	list.BanAddress(net.ParseIP("192.168.1.10"), clock.Now().Add(time.Minute))
+	list.BanNetwork("10.0.0.0/8", clock.Now().Add(time.Minute))
+	list.BanNetwork("172.16.0.0/12", time.Time{})
+
+	if !list.IsClientIdBanned(10) || !list.IsAddressBanned(net.ParseIP("10.1.2.3")) {
+		t.Fatalf("expected bans to be active before they expire\n")
+	}
+
+	clock.Advance(time.Minute)
+	if !list.IsAddressBanned(net.ParseIP("172.16.0.1")) {
+		t.Fatalf("expected permanent network ban to remain\n")
+	}
+
+	// the network scan saw the expired network and removed every expired entry
+	if len(list.clientIds) != 0 || len(list.addresses) != 0 || len(list.networks) != 1 {
+		t.Fatalf("expected expired bans to be removed got %d client ids %d addresses %d networks\n", len(list.clientIds), len(list.addresses), len(list.networks))
+	}
+
+	list.BanClientId(11, clock.Now().Add(time.Minute))
+	clock.Advance(time.Minute)
+	path := filepath.Join(os.TempDir(), "netcode_access_list_expired_test.json")
+	defer os.Remove(path)
+	if err := list.Save(path); err != nil {
+		t.Fatalf("error saving access list: %s\n", err)
+	}
+
+	if len(list.clientIds) != 0 {
+		t.Fatalf("expected Save to remove expired client ids\n")
+	}
+}
+
+func TestServerAccessList(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40003}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	accessList := NewAccessList()
+	serv.SetAccessList(accessList)
+
+	kicked := false
+	serv.SetEventHandler(func(event *ServerEvent) {
+		if event.Type == EventClientKicked && event.ClientId == TEST_CLIENT_ID {
+			kicked = true
+		}
+	})
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	servers := []net.UDPAddr{addr}
+	connect := func() *Client {
+		client := NewClient(testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t))
+		if err := client.Connect(); err != nil {
+			t.Fatalf("error connecting: %s\n", err)
+		}
+		return client
+	}
+
+	// steps both sides until the client reaches a state <= disconnected or connected
+	run := func(client *Client, until func() bool) {
+		clientTime := float64(0)
+		for i := 0; i < 200 && !until(); i += 1 {
+			client.Update(clientTime)
+			time.Sleep(10 * time.Millisecond)
+			clientTime += 0.01
+			serv.Update(serv.serverTime + 0.01)
+		}
+	}
+
+	client := connect()
+	defer client.Close()
+	run(client, func() bool { return client.GetState() == StateConnected })
+	if client.GetState() != StateConnected {
+		t.Fatalf("expected client to connect got: %s\n", clientStateMap[client.GetState()])
+	}
+
+	accessList.BanClientId(TEST_CLIENT_ID, time.Time{})
+	run(client, func() bool { return kicked })
+	if !kicked || serv.HasClients() != 0 {
+		t.Fatalf("expected banned client to be kicked\n")
+	}
+
+	denied := connect()
+	defer denied.Close()
+	run(denied, func() bool { return denied.GetState() <= StateDisconnected })
+	if denied.GetState() != StateConnectionDenied {
+		t.Fatalf("expected banned client to be denied got: %s\n", clientStateMap[denied.GetState()])
+	}
+}
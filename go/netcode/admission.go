@@ -0,0 +1,70 @@
+package netcode
+
+import "net"
+
+// The result of an AdmissionHandler.
+type AdmissionDecision int
+
+const (
+	AdmissionAccept AdmissionDecision = iota // continue with the connection
+	AdmissionIgnore                          // silently drop the packet
+	AdmissionDeny                            // reply with a connection denied packet
+)
+
+// reference map of admission decision -> string values
+var admissionDecisionMap = map[AdmissionDecision]string{
+	AdmissionAccept: "accept",
+	AdmissionIgnore: "ignore",
+	AdmissionDeny:   "deny",
+}
+
+func (d AdmissionDecision) String() string {
+	return admissionDecisionMap[d]
+}
+
+// The details of a client attempting to connect, passed to the AdmissionHandler.
+type AdmissionRequest struct {
+	ClientId      uint64       // client id from the connect token
+	Address       *net.UDPAddr // address the packet was recv'd from
+	UserData      []byte       // copy of the USER_DATA_BYTES of user data from the connect token
+	TokenSequence uint64       // sequence the connect token was generated with
+	Response      bool         // false for the connection request, true for the connection response immediately before the client is connected
+}
+
+// Called for every connection request that passes the server's own checks, and again for
+// the connection response before the client is connected. Called from the same goroutine
+// as Update so it should return quickly.
+type AdmissionHandler func(request *AdmissionRequest) AdmissionDecision
+
+// Sets the handler deciding whether clients may connect, nil accepts everyone.
+func (s *Server) SetAdmissionHandler(admissionHandlerFn AdmissionHandler) {
+	s.admissionHandlerFn = admissionHandlerFn
+}
+
+// runs the admission handler, returns true if the connection should continue. Denied
+// clients are sent a denied packet using sendKey.
+func (s *Server) admit(request *AdmissionRequest, sendKey []byte) bool {
+	if s.admissionHandlerFn == nil {
+		return true
+	}
+
+	decision := s.admissionHandlerFn(request)
+	switch decision {
+	case AdmissionAccept:
+		return true
+	case AdmissionDeny:
+		s.logger.Log(LogLevelInfo, "server denied connection. rejected by admission handler", fieldClientId(request.ClientId), fieldAddress(request.Address), LogField{"response", request.Response})
+		s.sendDeniedPacket(sendKey, request.Address)
+	default:
+		s.logger.Log(LogLevelDebug, "server ignored connection. rejected by admission handler", fieldClientId(request.ClientId), fieldAddress(request.Address), LogField{"response", request.Response})
+		s.stats.addIgnored()
+	}
+	return false
+}
+
+func newAdmissionRequest(clientId uint64, addr *net.UDPAddr, userData []byte, tokenSequence uint64, response bool) *AdmissionRequest {
+	request := &AdmissionRequest{ClientId: clientId, Address: addr, TokenSequence: tokenSequence, Response: response}
+	request.UserData = make([]byte, len(userData))
+	copy(request.UserData, userData)
+	return request
+}
@@ -0,0 +1,87 @@
+package netcode
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerAdmissionHandler(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40004}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+
+	requests := make([]*AdmissionRequest, 0)
+	decision := AdmissionAccept
+	serv.SetAdmissionHandler(func(request *AdmissionRequest) AdmissionDecision {
+		requests = append(requests, request)
+		if request.Response {
+			return decision
+		}
+		return AdmissionAccept
+	})
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	servers := []net.UDPAddr{addr}
+	connect := func() (*Client, ClientState) {
+		connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+		client := NewClient(connectToken)
+		if err := client.Connect(); err != nil {
+			t.Fatalf("error connecting: %s\n", err)
+		}
+
+		clientTime := float64(0)
+		for i := 0; i < 200; i += 1 {
+			client.Update(clientTime)
+			if state := client.GetState(); state <= StateDisconnected || state == StateConnected {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+			clientTime += 0.01
+			serv.Update(serv.serverTime + 0.01)
+		}
+
+		if len(requests) < 2 {
+			t.Fatalf("expected admission handler to be called for request and response got %d calls\n", len(requests))
+		}
+
+		userData := connectToken.PrivateData.UserData
+		for _, request := range requests {
+			if request.ClientId != TEST_CLIENT_ID || request.TokenSequence != TEST_SEQUENCE_START || !bytes.Equal(request.UserData, userData) {
+				t.Fatalf("admission request did not match connect token: %#v\n", request)
+			}
+		}
+
+		if requests[0].Response || !requests[len(requests)-1].Response {
+			t.Fatalf("expected request stage before response stage\n")
+		}
+		return client, client.GetState()
+	}
+
+	decision = AdmissionDeny
+	denied, state := connect()
+	denied.Close()
+	if state != StateConnectionDenied {
+		t.Fatalf("expected client to be denied got: %s\n", clientStateMap[state])
+	}
+
+	if serv.HasClients() != 0 {
+		t.Fatalf("denied client should not be connected\n")
+	}
+
+	decision = AdmissionAccept
+	requests = requests[:0]
+	accepted, state := connect()
+	defer accepted.Close()
+	if state != StateConnected {
+		t.Fatalf("expected client to connect got: %s\n", clientStateMap[state])
+	}
+}
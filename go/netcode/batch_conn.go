@@ -0,0 +1,125 @@
+package netcode
+
+import (
+	"errors"
+	"net"
+
+	"golang.org/x/net/ipv4"
+)
+
+// Packets read or written per system call when batching is enabled.
+const DEFAULT_BATCH_SIZE = 64
+
+// Batches use recvmmsg and sendmmsg on linux, other platforms fall back to a message per
+// system call.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// the ipv4 PacketConn batches payloads on IPv6 sockets too, only its header and control
+// message options are specific to IPv4, so ipv6 does not need to be vendored.
+func newBatchConn(conn *net.UDPConn) batchConn {
+	return ipv4.NewPacketConn(conn)
+}
+
+// returns messages reading into pooled NetcodeData buffers, data[i] backs msgs[i].
+func newReadMessages(count int) ([]ipv4.Message, []*NetcodeData) {
+	msgs := make([]ipv4.Message, count)
+	data := make([]*NetcodeData, count)
+	for i := range msgs {
+		data[i] = acquireNetcodeData()
+		msgs[i].Buffers = [][]byte{data[i].buffer}
+	}
+	return msgs, data
+}
+
+func newWriteMessages(count, maxBytes int) []ipv4.Message {
+	msgs := make([]ipv4.Message, count)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, maxBytes)}
+	}
+	return msgs
+}
+
+// Sets the number of packets read and written per system call, 0 or 1 disables batching.
+// Must be called before Listen or Dial.
+func (c *NetcodeConn) SetBatchSize(size int) {
+	c.batchSize = size
+}
+
+func (c *NetcodeConn) createBatch() {
+	if c.batchSize <= 1 || c.conn == nil {
+		c.batch = nil
+		return
+	}
+	c.batch = newBatchConn(c.conn)
+	c.readMsgs, c.readData = newReadMessages(c.batchSize)
+	c.writeMsgs = newWriteMessages(c.batchSize, c.maxBytes)
+	c.writeCount = 0
+}
+
+// reads up to batchSize packets in one call and dispatches each of them. Buffers handed to
+// the recvHandlerFn are replaced from the pool so the next read does not overwrite them.
+func (c *NetcodeConn) readBatch() error {
+	n, err := c.batch.ReadBatch(c.readMsgs, 0)
+	if err != nil {
+		return err
+	}
+
+	var dispatchErr error
+	for i := 0; i < n; i += 1 {
+		msg := &c.readMsgs[i]
+		from, _ := msg.Addr.(*net.UDPAddr)
+		if err := c.dispatch(c.readData[i], msg.N, from); err != nil {
+			dispatchErr = err
+		}
+		c.readData[i] = acquireNetcodeData()
+		msg.Buffers[0] = c.readData[i].buffer
+	}
+	return dispatchErr
+}
+
+// queues the packet to be sent by the next flushWrites, or sends it immediately if batching
+// is disabled. The packet is copied so the caller may reuse the buffer.
+func (c *NetcodeConn) queueWriteTo(b []byte, to *net.UDPAddr) error {
+	if c.batch == nil {
+		_, err := c.WriteTo(b, to)
+		return err
+	}
+
+	if c.isClosed {
+		return errors.New("unable to write, socket has been closed")
+	}
+
+	if c.writeCount == len(c.writeMsgs) {
+		if err := c.flushWrites(); err != nil {
+			return err
+		}
+	}
+
+	msg := &c.writeMsgs[c.writeCount]
+	buffer := msg.Buffers[0][:cap(msg.Buffers[0])]
+	msg.Buffers[0] = buffer[:copy(buffer, b)]
+	msg.Addr = to
+	c.writeCount++
+	return nil
+}
+
+// sends the queued packets, the queue is emptied even if sending fails.
+func (c *NetcodeConn) flushWrites() error {
+	pending := c.writeMsgs[:c.writeCount]
+	c.writeCount = 0
+	for len(pending) > 0 {
+		n, err := c.batch.WriteBatch(pending, 0)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return errors.New("socket error: 0 packets written")
+		}
+		pending = pending[n:]
+	}
+	return nil
+}
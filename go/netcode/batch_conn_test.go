@@ -0,0 +1,100 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetcodeConnBatch(t *testing.T) {
+	const numPackets = 100
+	recvCh := make(chan *NetcodeData, numPackets)
+
+	recv := NewNetcodeConn()
+	recv.SetBatchSize(DEFAULT_BATCH_SIZE)
+	recv.SetRecvHandler(func(data *NetcodeData) { recvCh <- data })
+	if err := recv.Listen(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer recv.Close()
+
+	send := NewNetcodeConn()
+	send.SetBatchSize(16)
+	send.SetRecvHandler(func(data *NetcodeData) {})
+	if err := send.Listen(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer send.Close()
+
+	to := recv.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < numPackets; i += 1 {
+		if err := send.queueWriteTo([]byte{byte(ConnectionPayload), byte(i)}, to); err != nil {
+			t.Fatalf("error queueing packet: %s\n", err)
+		}
+	}
+
+	if err := send.flushWrites(); err != nil {
+		t.Fatalf("error flushing writes: %s\n", err)
+	}
+
+	from := send.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < numPackets; i += 1 {
+		select {
+		case data := <-recvCh:
+			if len(data.data) != 2 || data.data[1] != byte(i) {
+				t.Fatalf("expected packet %d got %v\n", i, data.data)
+			}
+
+			if !addressEqual(data.from, from) || data.conn != recv {
+				t.Fatalf("expected packet from %s on the receiving socket got %s\n", from, data.from)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for packet %d\n", i)
+		}
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	benchmarkWrites(b, 0)
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	benchmarkWrites(b, DEFAULT_BATCH_SIZE)
+}
+
+// sends a payload sized packet to each of 256 clients per op, as SendPayloads does.
+func benchmarkWrites(b *testing.B, batchSize int) {
+	const numClients = 256
+
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("::1"), Port: 0})
+	if err != nil {
+		b.Fatalf("error listening: %s\n", err)
+	}
+	defer sink.Close()
+
+	conn := NewNetcodeConn()
+	conn.SetBatchSize(batchSize)
+	conn.SetRecvHandler(func(data *NetcodeData) {})
+	if err := conn.Listen(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}); err != nil {
+		b.Fatalf("error listening: %s\n", err)
+	}
+	defer conn.Close()
+
+	to := sink.LocalAddr().(*net.UDPAddr)
+	packet := make([]byte, 256)
+	packet[0] = byte(ConnectionPayload)
+	b.SetBytes(int64(len(packet) * numClients))
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n += 1 {
+		for i := 0; i < numClients; i += 1 {
+			if err := conn.queueWriteTo(packet, to); err != nil {
+				b.Fatalf("error writing packet: %s\n", err)
+			}
+		}
+
+		if err := conn.flushWrites(); err != nil {
+			b.Fatalf("error flushing writes: %s\n", err)
+		}
+	}
+}
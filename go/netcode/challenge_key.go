@@ -0,0 +1,76 @@
+package netcode
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Challenge key state. The challenge sequence is never reset on rotation so a key is never
+// used with the same nonce twice, and the sequence a key started at identifies which key a
+// challenge token was encrypted with.
+type challengeKeys struct {
+	interval float64 // seconds between rotations, 0 disables rotation
+	overlap  float64 // seconds the previous key is still accepted for
+
+	keySequence uint64  // challenge sequence the current key was first used at
+	rotateTime  float64 // server time of the next rotation, -1 until the first Update
+
+	prevKey         []byte
+	prevKeySequence uint64
+	prevKeyExpire   float64
+}
+
+// Sets how often the challenge key is regenerated and how long the previous key is still
+// accepted for handshakes in flight. An interval of 0 disables rotation, which is the default.
+// The overlap is capped at the interval so at most two keys are ever valid.
+func (s *Server) SetChallengeKeyRotation(interval, overlap time.Duration) {
+	if overlap > interval {
+		overlap = interval
+	}
+	s.challenge.interval = interval.Seconds()
+	s.challenge.overlap = overlap.Seconds()
+	s.challenge.rotateTime = -1
+}
+
+// called from Update, rotates the challenge key once the interval has elapsed.
+func (s *Server) checkChallengeKeyRotation() {
+	if s.challenge.interval <= 0 {
+		return
+	}
+
+	if s.challenge.rotateTime < 0 {
+		s.challenge.rotateTime = s.serverTime + s.challenge.interval
+		return
+	}
+
+	if s.serverTime < s.challenge.rotateTime {
+		return
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		s.logger.Log(LogLevelError, "server failed to generate challenge key", fieldError(err))
+		return
+	}
+
+	s.challenge.prevKey = s.challengeKey
+	s.challenge.prevKeySequence = s.challenge.keySequence
+	s.challenge.prevKeyExpire = s.serverTime + s.challenge.overlap
+	s.challengeKey = key
+	s.challenge.keySequence = atomic.LoadUint64(&s.challengeSequence)
+	s.challenge.rotateTime = s.serverTime + s.challenge.interval
+	s.logger.Log(LogLevelDebug, "server rotated challenge key", LogField{"sequence", s.challenge.keySequence})
+}
+
+// returns the key challenge tokens with the sequence were encrypted with, or nil if that
+// key has expired.
+func (s *Server) challengeKeyForSequence(sequence uint64) []byte {
+	if sequence >= s.challenge.keySequence {
+		return s.challengeKey
+	}
+
+	if s.challenge.prevKey != nil && sequence >= s.challenge.prevKeySequence && s.serverTime < s.challenge.prevKeyExpire {
+		return s.challenge.prevKey
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package netcode
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChallengeKeyRotation(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.SetChallengeKeyRotation(10*time.Second, 2*time.Second)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	// encrypts a challenge token the same way sendChallengePacket does
+	encrypt := func() ([]byte, uint64) {
+		challengeBuf := NewChallengeToken(TEST_CLIENT_ID).Write(make([]byte, USER_DATA_BYTES))
+		sequence := serv.incChallengeSequence()
+		if err := EncryptChallengeToken(challengeBuf, sequence, serv.challengeKey); err != nil {
+			t.Fatalf("error encrypting challenge token: %s\n", err)
+		}
+		return challengeBuf, sequence
+	}
+
+	decrypt := func(challengeBuf []byte, sequence uint64) bool {
+		key := serv.challengeKeyForSequence(sequence)
+		if key == nil {
+			return false
+		}
+		buf := make([]byte, len(challengeBuf))
+		copy(buf, challengeBuf)
+		_, err := DecryptChallengeToken(buf, sequence, key)
+		return err == nil
+	}
+
+	serv.Update(0)
+	firstKey := serv.challengeKey
+	oldToken, oldSequence := encrypt()
+
+	serv.Update(9.9)
+	if !bytes.Equal(firstKey, serv.challengeKey) {
+		t.Fatalf("challenge key rotated before the interval elapsed\n")
+	}
+
+	serv.Update(10)
+	if bytes.Equal(firstKey, serv.challengeKey) {
+		t.Fatalf("expected challenge key to rotate after the interval\n")
+	}
+
+	newToken, newSequence := encrypt()
+	if newSequence <= oldSequence {
+		t.Fatalf("challenge sequence must not be reset by rotation\n")
+	}
+
+	if !decrypt(oldToken, oldSequence) {
+		t.Fatalf("expected token from previous key to decrypt within the overlap\n")
+	}
+
+	if !decrypt(newToken, newSequence) {
+		t.Fatalf("expected token from current key to decrypt\n")
+	}
+
+	serv.Update(12)
+	if decrypt(oldToken, oldSequence) {
+		t.Fatalf("expected token from previous key to be rejected after the overlap\n")
+	}
+
+	if !decrypt(newToken, newSequence) {
+		t.Fatalf("expected token from current key to decrypt\n")
+	}
+}
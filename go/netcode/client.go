@@ -2,9 +2,8 @@ package netcode
 
 import (
 	"errors"
-	"log"
 	"net"
-	"time"
+	"sync/atomic"
 )
 
 const CLIENT_MAX_RECEIVE_PACKETS = 64
@@ -71,6 +70,29 @@ type Client struct {
 	packetQueue      *PacketQueue
 	allowedPackets   []byte
 	packetCh         chan *NetcodeData
+	transport        Transport // used instead of a UDP socket when set
+	clock            Clock
+
+	// reused for every send from the goroutine calling Update
+	packetBuffer    []byte
+	payloadPacket   PayloadPacket
+	keepAlivePacket KeepAlivePacket
+
+	// ciphers cached for the session keys, reset with the connection
+	sendCrypto packetCrypto
+	recvCrypto packetCrypto
+
+	loopback          bool
+	loopbackHandlerFn LoopbackSendHandler
+	logger            Logger
+	stats             *TrafficStats
+
+	tickRate     float64
+	runState     int32 // 0 not run, 1 running, 2 finished
+	payloadCh    chan *ClientPayload
+	stateCh      chan ClientState
+	stateChanges []ClientState // state changes not yet delivered on stateCh
+	sendCh       chan []byte
 }
 
 func NewClient(connectToken *ConnectToken) *Client {
@@ -82,6 +104,7 @@ func NewClient(connectToken *ConnectToken) *Client {
 	c.setState(StateDisconnected)
 	c.shouldDisconnect = false
 	c.challengeData = make([]byte, CHALLENGE_TOKEN_BYTES)
+	c.packetBuffer = make([]byte, MAX_PACKET_BYTES)
 
 	c.context = &Context{}
 	c.packetQueue = NewPacketQueue(PACKET_QUEUE_SIZE)
@@ -93,9 +116,41 @@ func NewClient(connectToken *ConnectToken) *Client {
 	c.allowedPackets[ConnectionKeepAlive] = 1
 	c.allowedPackets[ConnectionPayload] = 1
 	c.allowedPackets[ConnectionDisconnect] = 1
+	c.logger = NewLogger(LogLevelInfo)
+	c.stats = &TrafficStats{}
+	c.clock = systemClock{}
+
+	c.tickRate = DEFAULT_TICK_RATE
+	c.payloadCh = make(chan *ClientPayload, PACKET_QUEUE_SIZE)
+	c.stateCh = make(chan ClientState, CLIENT_STATE_QUEUE_SIZE)
+	c.sendCh = make(chan []byte, PACKET_QUEUE_SIZE)
 	return c
 }
 
+// Sets the clock packets from the server are checked against, nil reverts to the system clock.
+func (c *Client) SetClock(clock Clock) {
+	c.clock = clockOrSystem(clock)
+}
+
+// Sets the transport the client sends and receives packets on instead of dialing a UDP socket,
+// such as a MemoryTransport or a relay socket. Packets are written to the server address from the
+// connect token. The client closes the transport when closed. Must be called before Connect.
+func (c *Client) SetTransport(transport Transport) {
+	c.transport = transport
+}
+
+// Sets the logger used by the client and its connection, a nil logger disables logging.
+func (c *Client) SetLogger(logger Logger) {
+	c.logger = loggerOrNone(logger)
+	if c.conn != nil {
+		c.conn.SetLogger(c.logger)
+	}
+}
+
+func (c *Client) fieldId() LogField {
+	return LogField{Key: "client", Value: c.id}
+}
+
 func (c *Client) GetState() ClientState {
 	return c.state
 }
@@ -105,6 +160,9 @@ func (c *Client) SetId(id uint64) {
 }
 
 func (c *Client) setState(newState ClientState) {
+	if atomic.LoadInt32(&c.runState) == 1 && newState != c.state {
+		c.stateChanges = append(c.stateChanges, newState)
+	}
 	c.state = newState
 }
 
@@ -119,7 +177,11 @@ func (c *Client) Connect() error {
 	c.serverAddress = &c.connectToken.ServerAddrs[c.serverIndex]
 
 	c.conn = NewNetcodeConn()
+	c.conn.SetLogger(c.logger)
 	c.conn.SetRecvHandler(c.handleNetcodeData)
+	if c.transport != nil {
+		c.conn.SetTransport(c.transport)
+	}
 	if err = c.conn.Dial(c.serverAddress); err != nil {
 		return err
 	}
@@ -141,9 +203,9 @@ func (c *Client) connectNextServer() bool {
 
 	c.Reset()
 
-	log.Printf("client[%d] connecting to next server %s (%d/%d)\n", c.id, c.serverAddress.String(), c.serverIndex, len(c.connectToken.ServerAddrs))
+	c.logger.Log(LogLevelInfo, "client connecting to next server", c.fieldId(), fieldAddress(c.serverAddress), LogField{"serverIndex", c.serverIndex}, LogField{"numServers", len(c.connectToken.ServerAddrs)})
 	if err := c.Connect(); err != nil {
-		log.Printf("error connecting to next server: %s\n", err)
+		c.logger.Log(LogLevelError, "error connecting to next server", c.fieldId(), fieldError(err))
 		return false
 	}
 	c.setState(StateSendingConnectionRequest)
@@ -151,6 +213,9 @@ func (c *Client) connectNextServer() bool {
 }
 
 func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
 	return c.conn.Close()
 }
 
@@ -162,6 +227,8 @@ func (c *Client) Reset() {
 	c.challengeData = make([]byte, CHALLENGE_TOKEN_BYTES)
 	c.challengeSequence = 0
 	c.replayProtection.Reset()
+	c.sendCrypto.reset()
+	c.recvCrypto.reset()
 }
 
 func (c *Client) resetConnectionData(newState ClientState) {
@@ -173,10 +240,13 @@ func (c *Client) resetConnectionData(newState ClientState) {
 	c.serverAddress = nil
 	c.connectToken = nil
 	c.context = nil
+	c.loopback = false
 	c.setState(newState)
 	c.Reset()
 	c.packetQueue.Clear()
-	c.conn.Close()
+	if c.conn != nil {
+		c.conn.Close()
+	}
 }
 
 func (c *Client) LocalAddr() net.Addr {
@@ -190,24 +260,28 @@ func (c *Client) RemoteAddr() net.Addr {
 func (c *Client) Update(t float64) {
 	c.time = t
 
+	if c.loopback {
+		return
+	}
+
 	c.recv()
 
 	if err := c.send(); err != nil {
-		log.Printf("error sending packet: %s\n", err)
+		c.logger.Log(LogLevelError, "error sending packet", c.fieldId(), fieldError(err))
 	}
 
 	state := c.GetState()
 	if state > StateDisconnected && state < StateConnected {
 		expire := c.connectToken.ExpireTimestamp - c.connectToken.CreateTimestamp
 		if c.startTime+float64(expire) <= c.time {
-			log.Printf("client[%d] connect failed. connect token expired\n", c.id)
+			c.logger.Log(LogLevelInfo, "client connect failed. connect token expired", c.fieldId())
 			c.Disconnect(StateTokenExpired, false)
 			return
 		}
 	}
 
 	if c.shouldDisconnect {
-		log.Printf("client[%d] should disconnect -> %s\n", c.id, clientStateMap[c.shouldDisconnectState])
+		c.logger.Log(LogLevelInfo, "client should disconnect", c.fieldId(), LogField{"state", clientStateMap[c.shouldDisconnectState]})
 		if c.connectNextServer() {
 			return
 		}
@@ -219,7 +293,7 @@ func (c *Client) Update(t float64) {
 	case StateSendingConnectionRequest:
 		timeout := c.lastPacketRecvTime + float64(c.connectToken.TimeoutSeconds*1000)
 		if timeout < c.time {
-			log.Printf("client[%d] connection request timed out.\n", c.id)
+			c.logger.Log(LogLevelInfo, "client connection request timed out", c.fieldId())
 			if c.connectNextServer() {
 				return
 			}
@@ -228,7 +302,7 @@ func (c *Client) Update(t float64) {
 	case StateSendingConnectionResponse:
 		timeout := c.lastPacketRecvTime + float64(c.connectToken.TimeoutSeconds*1000)
 		if timeout < c.time {
-			log.Printf("client[%d] connect failed. connection response timed out\n", c.id)
+			c.logger.Log(LogLevelInfo, "client connect failed. connection response timed out", c.fieldId())
 			if c.connectNextServer() {
 				return
 			}
@@ -237,7 +311,7 @@ func (c *Client) Update(t float64) {
 	case StateConnected:
 		timeout := c.lastPacketRecvTime + float64(c.connectToken.TimeoutSeconds*1000)
 		if timeout < c.time {
-			log.Printf("client[%d] connection timed out\n", c.id)
+			c.logger.Log(LogLevelInfo, "client connection timed out", c.fieldId())
 			c.Disconnect(StateConnectionTimedOut, false)
 		}
 	}
@@ -249,6 +323,7 @@ func (c *Client) recv() {
 		select {
 		case recv := <-c.packetCh:
 			c.OnPacketData(recv.data, recv.from)
+			recv.release()
 		default:
 			return
 		}
@@ -256,13 +331,13 @@ func (c *Client) recv() {
 }
 
 func (c *Client) Disconnect(reason ClientState, sendDisconnect bool) error {
-	log.Printf("client[%d] disconnected: %s\n", c.id, clientStateMap[reason])
+	c.logger.Log(LogLevelInfo, "client disconnected", c.fieldId(), LogField{"reason", clientStateMap[reason]})
 	if c.GetState() <= StateDisconnected {
-		log.Printf("state <= StateDisconnected")
+		c.logger.Log(LogLevelDebug, "client already disconnected", c.fieldId())
 		return nil
 	}
 
-	if sendDisconnect && c.GetState() > StateDisconnected {
+	if !c.loopback && sendDisconnect && c.GetState() > StateDisconnected {
 		for i := 0; i < NUM_DISCONNECT_PACKETS; i += 1 {
 			packet := &DisconnectPacket{}
 			c.sendPacket(packet)
@@ -272,12 +347,30 @@ func (c *Client) Disconnect(reason ClientState, sendDisconnect bool) error {
 	return nil
 }
 
+// Sends the payload to the server. While the client is driven by Run the payload is
+// copied and queued for the next tick, so SendData may be called from any goroutine.
 func (c *Client) SendData(payloadData []byte) error {
+	if atomic.LoadInt32(&c.runState) == 1 {
+		return c.queueSend(payloadData)
+	}
+	return c.sendData(payloadData)
+}
+
+func (c *Client) sendData(payloadData []byte) error {
 	if c.GetState() != StateConnected {
 		return errors.New("client not connected, unable to send packet")
 	}
-	p := NewPayloadPacket(payloadData)
-	return c.sendPacket(p)
+
+	if c.loopback {
+		c.loopbackHandlerFn(int(c.clientIndex), payloadData, c.sequence)
+		c.sequence++
+		return nil
+	}
+	c.payloadPacket.PayloadBytes = uint32(len(payloadData))
+	c.payloadPacket.PayloadData = payloadData
+	err := c.sendPacket(&c.payloadPacket)
+	c.payloadPacket.PayloadData = nil
+	return err
 }
 
 func (c *Client) send() error {
@@ -294,48 +387,63 @@ func (c *Client) send() error {
 		p.ConnectTokenExpireTimestamp = c.connectToken.ExpireTimestamp
 		p.ConnectTokenSequence = c.connectToken.Sequence
 		p.ConnectTokenData = c.connectToken.PrivateData.Buffer()
-		log.Printf("client[%d] sent connection request packet to server\n", c.id)
+		if logEnabled(c.logger, LogLevelDebug) {
+			c.logger.Log(LogLevelDebug, "client sent connection request packet to server", c.fieldId())
+		}
 		return c.sendPacket(p)
 	case StateSendingConnectionResponse:
 		p := &ResponsePacket{}
 		p.ChallengeTokenSequence = c.challengeSequence
 		p.ChallengeTokenData = c.challengeData
-		log.Printf("client[%d] sent connection response packet to server\n", c.id)
+		if logEnabled(c.logger, LogLevelDebug) {
+			c.logger.Log(LogLevelDebug, "client sent connection response packet to server", c.fieldId())
+		}
 		return c.sendPacket(p)
 	case StateConnected:
-		p := &KeepAlivePacket{}
-		p.ClientIndex = 0
-		p.MaxClients = 0
-		log.Printf("client[%d] sent connection keep-alive packet to server\n", c.id)
-		return c.sendPacket(p)
+		c.keepAlivePacket.ClientIndex = 0
+		c.keepAlivePacket.MaxClients = 0
+		if logEnabled(c.logger, LogLevelDebug) {
+			c.logger.Log(LogLevelDebug, "client sent connection keep-alive packet to server", c.fieldId())
+		}
+		return c.sendPacket(&c.keepAlivePacket)
 	}
 
 	return nil
 }
 
 func (c *Client) sendPacket(packet Packet) error {
-	buffer := make([]byte, MAX_PACKET_BYTES)
-	packet_bytes, err := packet.Write(buffer, c.connectToken.ProtocolId, c.sequence, c.context.WritePacketKey)
+	packet_bytes, err := writeSessionPacket(packet, c.packetBuffer, c.connectToken.ProtocolId, c.sequence, c.context.WritePacketKey, &c.sendCrypto)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.conn.Write(buffer[:packet_bytes])
+	_, err = c.conn.Write(c.packetBuffer[:packet_bytes])
 	if err != nil {
-		log.Printf("error writing packet %s to server: %s\n", packetTypeMap[packet.GetType()], err)
+		c.logger.Log(LogLevelError, "error writing packet to server", c.fieldId(), fieldPacketType(packet.GetType()), fieldError(err))
+	} else {
+		c.stats.addSent(packet_bytes)
 	}
 	c.lastPacketSendTime = c.time
 	c.sequence++
 	return err
 }
 
+// Returns a copy of the next payload received from the server and its sequence, the packet is
+// returned to the pool. Use RecvPayloadPacket to avoid allocating the copy.
 func (c *Client) RecvData() ([]byte, uint64) {
 	packet := c.packetQueue.Pop()
 	p, ok := packet.(*PayloadPacket)
 	if !ok {
 		return nil, 0
 	}
-	return p.PayloadData, p.sequence
+	return p.copyAndRelease()
+}
+
+// Returns the next payload received from the server, or nil if there are none. Unlike
+// RecvData the payload's buffer is reused once Release is called on the packet.
+func (c *Client) RecvPayloadPacket() *PayloadPacket {
+	p, _ := c.packetQueue.Pop().(*PayloadPacket)
+	return p
 }
 
 // write the netcodeData to our unbuffered packet channel. The NetcodeConn verifies
@@ -351,19 +459,32 @@ func (c *Client) OnPacketData(packetData []byte, from *net.UDPAddr) {
 	var sequence uint64
 
 	if !addressEqual(c.serverAddress, from) {
-		log.Printf("client[%d] unknown/old server address sent us data %s != %s\n", c.id, c.serverAddress.String(), from.String())
+		if logEnabled(c.logger, LogLevelDebug) {
+			c.logger.Log(LogLevelDebug, "client ignored data from unknown/old server address", c.fieldId(), LogField{"server", c.serverAddress}, fieldAddress(from))
+		}
 		return
 	}
 
 	size = len(packetData)
-	timestamp := uint64(time.Now().Unix())
+	c.stats.addReceived(size)
+	timestamp := uint64(c.clock.Now().Unix())
 
-	packet := NewPacket(packetData)
-	if err = packet.Read(packetData, size, c.connectToken.ProtocolId, timestamp, c.context.ReadPacketKey, nil, c.allowedPackets, c.replayProtection); err != nil {
-		log.Printf("error reading packet: %s\n", err)
+	packet := newPooledPacket(packetData)
+	if err = readSessionPacket(packet, packetData, size, c.connectToken.ProtocolId, timestamp, c.context.ReadPacketKey, nil, c.allowedPackets, c.replayProtection, &c.recvCrypto); err != nil {
+		if logEnabled(c.logger, LogLevelDebug) {
+			c.logger.Log(LogLevelDebug, "client error reading packet", c.fieldId(), fieldAddress(from), fieldError(err))
+		}
+		c.stats.addReadError(err)
+		releasePacket(packet)
+		return
 	}
 
 	c.processPacket(packet, sequence)
+
+	// payloads are owned by the packet queue
+	if packet.GetType() != ConnectionPayload {
+		releasePacket(packet)
+	}
 }
 
 func (c *Client) processPacket(packet Packet, sequence uint64) {
@@ -400,10 +521,14 @@ func (c *Client) processPacket(packet Packet, sequence uint64) {
 		}
 	case ConnectionPayload:
 		if state != StateConnected {
+			releasePacket(packet)
 			return
 		}
 
-		c.packetQueue.Push(packet)
+		if c.packetQueue.Push(packet) == 0 {
+			c.stats.addQueueOverflow()
+			releasePacket(packet)
+		}
 	case ConnectionDisconnect:
 		if state != StateConnected {
 			return
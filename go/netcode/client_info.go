@@ -0,0 +1,59 @@
+package netcode
+
+import "net"
+
+// A snapshot of a connected client, the C equivalents are the netcode_server_client_* functions.
+type ClientInfo struct {
+	ClientId     uint64
+	ClientIndex  int          // slot the client occupies, pass to RecvPayload
+	Address      *net.UDPAddr // nil for loopback clients
+	UserData     []byte       // copy of the USER_DATA_BYTES of user data from the connect token
+	Confirmed    bool         // true once the client has sent a keep-alive or payload
+	Loopback     bool
+	ConnectTime  float64 // server time the client connected
+	LastSendTime float64 // server time a packet was last sent to the client
+	LastRecvTime float64 // server time a packet was last recv'd from the client
+	Sequence     uint64  // sequence number of the next packet sent to the client
+}
+
+func newClientInfo(client *ClientInstance) ClientInfo {
+	info := ClientInfo{
+		ClientId:     client.clientId,
+		ClientIndex:  client.clientIndex,
+		Address:      client.address,
+		Confirmed:    client.confirmed,
+		Loopback:     client.loopback,
+		ConnectTime:  client.connectTime,
+		LastSendTime: client.lastSendTime,
+		LastRecvTime: client.lastRecvTime,
+		Sequence:     client.sequence,
+	}
+	info.UserData = make([]byte, len(client.userData))
+	copy(info.UserData, client.userData)
+	return info
+}
+
+// Returns a snapshot of the connected client. Must be called from the same goroutine as Update.
+func (s *Server) ClientInfo(clientId uint64) (ClientInfo, error) {
+	clientIndex, err := s.getClientIndexByClientId(clientId)
+	if err != nil {
+		return ClientInfo{}, err
+	}
+	return newClientInfo(s.clientManager.instances[clientIndex]), nil
+}
+
+// Returns a snapshot of every connected client ordered by slot. Must be called from the
+// same goroutine as Update.
+func (s *Server) Clients() []ClientInfo {
+	clients := make([]ClientInfo, 0, s.clientManager.ConnectedClientCount())
+	if !s.running {
+		return clients
+	}
+
+	for _, client := range s.clientManager.instances {
+		if client.connected {
+			clients = append(clients, newClientInfo(client))
+		}
+	}
+	return clients
+}
@@ -0,0 +1,74 @@
+package netcode
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestServerClientInfo(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	serv.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {})
+	if len(serv.Clients()) != 0 {
+		t.Fatalf("expected no clients\n")
+	}
+
+	userData, err := RandomBytes(USER_DATA_BYTES)
+	if err != nil {
+		t.Fatalf("error generating user data: %s\n", err)
+	}
+
+	serv.Update(1.5)
+	if err := serv.ConnectLoopbackClient(2, TEST_CLIENT_ID, userData); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	if err := serv.ConnectLoopbackClient(0, TEST_CLIENT_ID+1, nil); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	if err := serv.SendPayloadToClient(TEST_CLIENT_ID, []byte("payload"), 2.0); err != nil {
+		t.Fatalf("error sending payload: %s\n", err)
+	}
+
+	info, err := serv.ClientInfo(TEST_CLIENT_ID)
+	if err != nil {
+		t.Fatalf("error getting client info: %s\n", err)
+	}
+
+	if info.ClientIndex != 2 || !info.Loopback || !info.Confirmed || info.Address != nil {
+		t.Fatalf("unexpected client info: %#v\n", info)
+	}
+
+	if info.ConnectTime != 1.5 || info.Sequence != 1 {
+		t.Fatalf("expected connect time 1.5 and sequence 1 got %f and %d\n", info.ConnectTime, info.Sequence)
+	}
+
+	if !bytes.Equal(info.UserData, userData) {
+		t.Fatalf("user data did not match\n")
+	}
+
+	info.UserData[0] ^= 0xff
+	if serv.clientManager.instances[2].userData[0] == info.UserData[0] {
+		t.Fatalf("user data should be a copy\n")
+	}
+
+	if _, err := serv.ClientInfo(TEST_CLIENT_ID + 2); err == nil {
+		t.Fatalf("expected error for unknown client id\n")
+	}
+
+	clients := serv.Clients()
+	if len(clients) != 2 || clients[0].ClientId != TEST_CLIENT_ID+1 || clients[1].ClientId != TEST_CLIENT_ID {
+		t.Fatalf("expected clients ordered by slot got: %#v\n", clients)
+	}
+}
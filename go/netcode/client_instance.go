@@ -2,7 +2,6 @@ package netcode
 
 import (
 	"errors"
-	"log"
 	"net"
 )
 
@@ -12,9 +11,11 @@ type ClientInstance struct {
 	serverConn  *NetcodeConn
 	confirmed   bool
 	connected   bool
+	loopback    bool
 
 	encryptionIndex  int
 	sequence         uint64
+	connectTime      float64
 	lastSendTime     float64
 	lastRecvTime     float64
 	userData         []byte
@@ -23,6 +24,12 @@ type ClientInstance struct {
 	address          *net.UDPAddr
 	packetQueue      *PacketQueue
 	packetData       []byte
+	logger           Logger
+	stats            *TrafficStats
+	serverStats      *TrafficStats // server wide totals, may be nil
+
+	keepAliveTimer timer
+	timeoutTimer   timer
 }
 
 func NewClientInstance() *ClientInstance {
@@ -31,6 +38,10 @@ func NewClientInstance() *ClientInstance {
 	c.packetQueue = NewPacketQueue(PACKET_QUEUE_SIZE)
 	c.packetData = make([]byte, MAX_PACKET_BYTES)
 	c.replayProtection = NewReplayProtection()
+	c.stats = &TrafficStats{}
+	c.logger = NewLogger(LogLevelInfo)
+	c.keepAliveTimer = newTimer(-1)
+	c.timeoutTimer = newTimer(-1)
 	return c
 }
 
@@ -38,28 +49,48 @@ func (c *ClientInstance) Clear() {
 	c.replayProtection.Reset()
 	c.connected = false
 	c.confirmed = false
+	c.loopback = false
 	c.clientId = 0
 	c.sequence = 0
+	c.connectTime = 0.0
 	c.lastSendTime = 0.0
 	c.lastRecvTime = 0.0
 	c.address = nil
 	c.clientIndex = -1
 	c.encryptionIndex = -1
 	c.packetQueue.Clear()
-	c.userData = make([]byte, USER_DATA_BYTES)
-	c.packetData = make([]byte, MAX_PACKET_BYTES)
+	c.stats.reset()
+	for i := range c.userData {
+		c.userData[i] = 0
+	}
 }
 
 func (c *ClientInstance) SendPacket(packet Packet, writePacketKey []byte, serverTime float64) error {
+	return c.writePacket(packet, writePacketKey, nil, serverTime, false)
+}
+
+// writes the packet with the encryption entry's cached cipher, or a new cipher if crypto is nil.
+func (c *ClientInstance) writePacket(packet Packet, writePacketKey []byte, crypto *packetCrypto, serverTime float64, queue bool) error {
 	var bytesWritten int
 	var err error
 
-	if bytesWritten, err = packet.Write(c.packetData, c.protocolId, c.sequence, writePacketKey); err != nil {
+	if bytesWritten, err = writeSessionPacket(packet, c.packetData, c.protocolId, c.sequence, writePacketKey, crypto); err != nil {
 		return errors.New("error: unable to write packet: " + err.Error())
 	}
 
-	if _, err := c.serverConn.WriteTo(c.packetData[:bytesWritten], c.address); err != nil {
-		log.Printf("error writing to client: %s\n", err)
+	if queue {
+		err = c.serverConn.queueWriteTo(c.packetData[:bytesWritten], c.address)
+	} else {
+		_, err = c.serverConn.WriteTo(c.packetData[:bytesWritten], c.address)
+	}
+
+	if err != nil {
+		c.logger.Log(LogLevelError, "error writing to client", fieldClientId(c.clientId), fieldAddress(c.address), fieldError(err))
+	} else {
+		c.stats.addSent(bytesWritten)
+		if c.serverStats != nil {
+			c.serverStats.addSent(bytesWritten)
+		}
 	}
 
 	c.sequence++
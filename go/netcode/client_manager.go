@@ -2,14 +2,16 @@ package netcode
 
 import (
 	"bytes"
-	"log"
 	"net"
 )
 
 type connectTokenEntry struct {
-	mac     []byte
-	address *net.UDPAddr
-	time    float64
+	mac        []byte
+	address    *net.UDPAddr
+	time       float64
+	expireTime float64 // server time the connect token expires, -1 if unknown
+	timer      timer
+	age        timer // scheduled at time in tokenAges while the entry holds a token
 }
 
 type encryptionEntry struct {
@@ -18,6 +20,13 @@ type encryptionEntry struct {
 	address    *net.UDPAddr
 	sendKey    []byte
 	recvKey    []byte
+
+	tokenSequence uint64 // sequence of the connect token which created this entry
+	timer         timer
+
+	// ciphers cached for the send and recv keys
+	sendCrypto packetCrypto
+	recvCrypto packetCrypto
 }
 
 type ClientManager struct {
@@ -31,8 +40,37 @@ type ClientManager struct {
 	cryptoEntries        []*encryptionEntry
 	numCryptoEntries     int
 
+	// indexes kept in step with the instances and entries so lookups do not scan every slot
+	clientsByAddress  map[addrKey]int
+	clientsById       map[uint64]int
+	numConnected      int
+	cryptoByAddress   map[addrKey]int
+	freeCryptoEntries []int // cleared encryption entries, lowest index last
+	tokensByMac       map[[MAC_BYTES]byte]int
+	freeTokenEntries  []int // token entries holding no token, used before evicting
+
+	// deadlines so each Update only visits the clients and entries which are due
+	keepAliveTimers *timerQueue
+	timeoutTimers   *timerQueue
+	cryptoTimers    *timerQueue
+	tokenTimers     *timerQueue
+	pendingConns    []*NetcodeConn // sockets with queued writes
+
+	// every token entry not in freeTokenEntries is in tokenAges at the time it was added, so the
+	// first is the oldest token whatever order the times were passed in
+	tokenAges *timerQueue
+
 	emptyMac      []byte // used to ensure empty mac (all empty bytes) doesn't match
 	emptyWriteKey []byte // used to test for empty write key
+
+	// reused for keep-alives and payloads written to every client
+	keepAlivePacket KeepAlivePacket
+	payloadPacket   PayloadPacket
+
+	eventHandlerFn    ServerEventHandler
+	loopbackHandlerFn LoopbackSendHandler
+	logger            Logger
+	stats             *ServerStats
 }
 
 func NewClientManager(timeout float64, maxClients int) *ClientManager {
@@ -43,6 +81,8 @@ func NewClientManager(timeout float64, maxClients int) *ClientManager {
 	m.timeout = timeout
 	m.emptyMac = make([]byte, MAC_BYTES)
 	m.emptyWriteKey = make([]byte, KEY_BYTES)
+	m.logger = NewLogger(LogLevelInfo)
+	m.stats = &ServerStats{}
 	m.resetClientInstances()
 	m.resetTokenEntries()
 	m.resetCryptoEntries()
@@ -51,39 +91,89 @@ func NewClientManager(timeout float64, maxClients int) *ClientManager {
 
 func (m *ClientManager) setTimeout(timeout float64) {
 	m.timeout = timeout
+	m.timeoutTimers.recheckAll()
+	m.cryptoTimers.recheckAll()
+}
+
+func (m *ClientManager) setEventHandler(eventHandlerFn ServerEventHandler) {
+	m.eventHandlerFn = eventHandlerFn
+}
+
+func (m *ClientManager) setLogger(logger Logger) {
+	m.logger = logger
+	for i := 0; i < m.maxClients; i += 1 {
+		m.instances[i].logger = logger
+	}
+}
+
+func (m *ClientManager) setLoopbackHandler(loopbackHandlerFn LoopbackSendHandler) {
+	m.loopbackHandlerFn = loopbackHandlerFn
+}
+
+// dispatches the event for the client to the event handler, if one is set.
+func (m *ClientManager) emitEvent(eventType ServerEventType, client *ClientInstance) {
+	if m.eventHandlerFn == nil {
+		return
+	}
+	m.eventHandlerFn(newServerEvent(eventType, client))
 }
 
 func (m *ClientManager) resetClientInstances() {
+	m.clientsByAddress = make(map[addrKey]int, m.maxClients)
+	m.clientsById = make(map[uint64]int, m.maxClients)
+	m.numConnected = 0
+	m.keepAliveTimers = newTimerQueue(m.maxClients)
+	m.timeoutTimers = newTimerQueue(m.maxClients)
 	m.instances = make([]*ClientInstance, m.maxClients)
 	for i := 0; i < m.maxClients; i += 1 {
 		instance := NewClientInstance()
+		instance.keepAliveTimer = newTimer(i)
+		instance.timeoutTimer = newTimer(i)
+		instance.logger = m.logger
+		instance.serverStats = &m.stats.TrafficStats
 		m.instances[i] = instance
 	}
 }
 
 // preallocate the token buffers so we don't have to do nil checks
 func (m *ClientManager) resetTokenEntries() {
+	m.tokensByMac = make(map[[MAC_BYTES]byte]int, m.maxEntries)
+	m.freeTokenEntries = make([]int, m.maxEntries)
+	m.tokenTimers = newTimerQueue(m.maxEntries)
+	m.tokenAges = newTimerQueue(m.maxEntries)
 	m.connectTokensEntries = make([]*connectTokenEntry, m.maxEntries)
 	for i := 0; i < m.maxEntries; i += 1 {
 		entry := &connectTokenEntry{}
+		entry.mac = make([]byte, MAC_BYTES)
+		entry.timer = newTimer(i)
+		entry.age = newTimer(i)
 		m.clearTokenEntry(entry)
 		m.connectTokensEntries[i] = entry
+		m.freeTokenEntries[m.maxEntries-1-i] = i
 	}
 }
 
 func (m *ClientManager) clearTokenEntry(entry *connectTokenEntry) {
-	entry.mac = make([]byte, MAC_BYTES)
+	for i := range entry.mac {
+		entry.mac[i] = 0
+	}
 	entry.address = nil
 	entry.time = -1
+	entry.expireTime = -1
 }
 
 // preallocate the crypto entries so we don't have to do nil checks
 func (m *ClientManager) resetCryptoEntries() {
+	m.cryptoByAddress = make(map[addrKey]int, m.maxEntries)
+	m.freeCryptoEntries = make([]int, m.maxEntries)
+	m.cryptoTimers = newTimerQueue(m.maxEntries)
 	m.cryptoEntries = make([]*encryptionEntry, m.maxEntries)
 	for i := 0; i < m.maxEntries; i += 1 {
 		entry := &encryptionEntry{}
+		entry.timer = newTimer(i)
 		m.clearCryptoEntry(entry)
 		m.cryptoEntries[i] = entry
+		m.freeCryptoEntries[m.maxEntries-1-i] = i
 	}
 }
 
@@ -93,6 +183,9 @@ func (m *ClientManager) clearCryptoEntry(entry *encryptionEntry) {
 	entry.address = nil
 	entry.sendKey = make([]byte, KEY_BYTES)
 	entry.recvKey = make([]byte, KEY_BYTES)
+	entry.tokenSequence = 0
+	entry.sendCrypto.reset()
+	entry.recvCrypto.reset()
 }
 
 func (m *ClientManager) FindFreeClientIndex() int {
@@ -111,7 +204,7 @@ func (m *ClientManager) ConnectedClients() []uint64 {
 	i := 0
 	for clientIndex := 0; clientIndex < m.maxClients; clientIndex += 1 {
 		client := m.instances[clientIndex]
-		if client.connected && client.address != nil {
+		if client.connected && (client.address != nil || client.loopback) {
 			m.connectedClientIds[i] = client.clientId
 			i++
 		}
@@ -120,14 +213,14 @@ func (m *ClientManager) ConnectedClients() []uint64 {
 }
 
 func (m *ClientManager) ConnectedClientCount() int {
-	return len(m.ConnectedClients())
+	return m.numConnected
 }
 
 // Initializes the client with the clientId
-func (m *ClientManager) ConnectClient(addr *net.UDPAddr, challengeToken *ChallengeToken) *ClientInstance {
+func (m *ClientManager) ConnectClient(addr *net.UDPAddr, challengeToken *ChallengeToken, serverTime float64) *ClientInstance {
 	clientIndex := m.FindFreeClientIndex()
 	if clientIndex == -1 {
-		log.Printf("failure to find free client index\n")
+		m.logger.Log(LogLevelError, "failure to find free client index", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
 		return nil
 	}
 	client := m.instances[clientIndex]
@@ -136,34 +229,82 @@ func (m *ClientManager) ConnectClient(addr *net.UDPAddr, challengeToken *Challen
 	client.sequence = 0
 	client.clientId = challengeToken.ClientId
 	client.address = addr
+	client.connectTime = serverTime
+	client.lastSendTime = serverTime
+	client.lastRecvTime = serverTime
 	copy(client.userData, challengeToken.UserData.Bytes())
+	m.clientsByAddress[newAddrKey(addr)] = clientIndex
+	m.clientsById[client.clientId] = clientIndex
+	m.numConnected++
+	m.keepAliveTimers.schedule(&client.keepAliveTimer, client.lastSendTime+float64(1.0/PACKET_SEND_RATE))
+	m.timeoutTimers.schedule(&client.timeoutTimer, client.lastRecvTime+m.timeout)
+	m.stats.addConnected()
 	return client
 }
 
+// Initializes the loopback client in the provided slot, returns nil if the slot is in use.
+func (m *ClientManager) ConnectLoopbackClient(clientIndex int, clientId uint64, userData []byte, serverTime float64) *ClientInstance {
+	client := m.instances[clientIndex]
+	if client.connected {
+		return nil
+	}
+	client.clientIndex = clientIndex
+	client.connected = true
+	client.confirmed = true
+	client.loopback = true
+	client.sequence = 0
+	client.clientId = clientId
+	client.address = nil
+	client.encryptionIndex = -1
+	client.connectTime = serverTime
+	client.lastSendTime = serverTime
+	client.lastRecvTime = serverTime
+	copy(client.userData, userData)
+	m.clientsById[clientId] = clientIndex
+	m.numConnected++
+	m.stats.addConnected()
+	return client
+}
+
+// removes the client from the indexes before its slot is cleared.
+func (m *ClientManager) removeClientIndexes(client *ClientInstance) {
+	if client.address != nil {
+		key := newAddrKey(client.address)
+		if index, ok := m.clientsByAddress[key]; ok && index == client.clientIndex {
+			delete(m.clientsByAddress, key)
+		}
+	}
+
+	if index, ok := m.clientsById[client.clientId]; ok && index == client.clientIndex {
+		delete(m.clientsById, client.clientId)
+	}
+	m.numConnected--
+	m.keepAliveTimers.cancel(&client.keepAliveTimer)
+	m.timeoutTimers.cancel(&client.timeoutTimer)
+}
+
 // Disconnects the client referenced by the provided clientIndex.
 func (m *ClientManager) DisconnectClient(clientIndex int, sendDisconnect bool, serverTime float64) {
 	instance := m.instances[clientIndex]
-	m.disconnectClient(instance, sendDisconnect, serverTime)
+	m.disconnectClient(instance, sendDisconnect, serverTime, EventClientKicked)
 }
 
 // Finds the client index referenced by the provided UDPAddr.
 func (m *ClientManager) FindClientIndexByAddress(addr *net.UDPAddr) int {
-	for i := 0; i < m.maxClients; i += 1 {
-		instance := m.instances[i]
-		if instance.address != nil && instance.connected && addressEqual(instance.address, addr) {
-			return i
-		}
+	if addr == nil {
+		return -1
+	}
+
+	if clientIndex, ok := m.clientsByAddress[newAddrKey(addr)]; ok {
+		return clientIndex
 	}
 	return -1
 }
 
 // Finds the client index via the provided clientId.
 func (m *ClientManager) FindClientIndexById(clientId uint64) int {
-	for i := 0; i < m.maxClients; i += 1 {
-		instance := m.instances[i]
-		if instance.address != nil && instance.connected && instance.clientId == clientId {
-			return i
-		}
+	if clientIndex, ok := m.clientsById[clientId]; ok {
+		return clientIndex
 	}
 	return -1
 }
@@ -179,50 +320,73 @@ func (m *ClientManager) FindEncryptionIndexByClientIndex(clientIndex int) int {
 
 // Finds an encryption entry index via the provided UDPAddr.
 func (m *ClientManager) FindEncryptionEntryIndex(addr *net.UDPAddr, serverTime float64) int {
-	for i := 0; i < m.numCryptoEntries; i += 1 {
-		entry := m.cryptoEntries[i]
-		if entry == nil || entry.address == nil {
-			continue
-		}
+	if addr == nil {
+		return -1
+	}
 
-		lastAccessTimeout := entry.lastAccess + m.timeout
-		if addressEqual(entry.address, addr) && serverTimedout(lastAccessTimeout, serverTime) && (entry.expireTime < 0 || entry.expireTime >= serverTime) {
-			entry.lastAccess = serverTime
-			return i
-		}
+	i, ok := m.cryptoByAddress[newAddrKey(addr)]
+	if !ok || i >= m.numCryptoEntries {
+		return -1
+	}
+
+	entry := m.cryptoEntries[i]
+	lastAccessTimeout := entry.lastAccess + m.timeout
+	if serverTimedout(lastAccessTimeout, serverTime) && (entry.expireTime < 0 || entry.expireTime >= serverTime) {
+		entry.lastAccess = serverTime
+		return i
 	}
 	return -1
 }
 
-// Finds or adds a token entry to our token entry slice.
+// Finds or adds a token entry to our token entry slice. Once every entry is in use the entry
+// added at the earliest serverTime is replaced.
 func (m *ClientManager) FindOrAddTokenEntry(connectTokenMac []byte, addr *net.UDPAddr, serverTime float64) bool {
-	var oldestTime float64
-
-	tokenIndex := -1
-	oldestIndex := -1
+	return m.findOrAddTokenEntry(connectTokenMac, addr, serverTime, -1)
+}
 
-	if bytes.Equal(connectTokenMac, m.emptyMac) {
+// finds or adds the token entry, a new entry is swept once the server time passes expireTime.
+// An expireTime of -1 keeps the entry until it is the oldest and replaced.
+func (m *ClientManager) findOrAddTokenEntry(connectTokenMac []byte, addr *net.UDPAddr, serverTime, expireTime float64) bool {
+	if bytes.Equal(connectTokenMac, m.emptyMac) || m.maxEntries == 0 {
 		return false
 	}
 
-	// find the matching entry for the token mac and the oldest token entry.
-	for i := 0; i < m.maxEntries; i += 1 {
-		if bytes.Equal(m.connectTokensEntries[i].mac, connectTokenMac) {
-			tokenIndex = i
+	var mac [MAC_BYTES]byte
+	copy(mac[:], connectTokenMac)
+	tokenIndex, ok := m.tokensByMac[mac]
+
+	// if no entry is found with the mac, this is a new connect token. use a free entry, otherwise
+	// replace the entry added at the earliest time whatever order tokens were added in.
+	if !ok {
+		var oldestIndex int
+		if len(m.freeTokenEntries) > 0 {
+			oldestIndex = m.freeTokenEntries[len(m.freeTokenEntries)-1]
+			m.freeTokenEntries = m.freeTokenEntries[:len(m.freeTokenEntries)-1]
+		} else {
+			oldestIndex = m.tokenAges.first().slot
 		}
+		entry := m.connectTokensEntries[oldestIndex]
 
-		if oldestIndex == -1 || m.connectTokensEntries[i].time < oldestTime {
-			oldestTime = m.connectTokensEntries[i].time
-			oldestIndex = i
+		var oldMac [MAC_BYTES]byte
+		copy(oldMac[:], entry.mac)
+		if index, ok := m.tokensByMac[oldMac]; ok && index == oldestIndex {
+			delete(m.tokensByMac, oldMac)
 		}
-	}
 
-	// if no entry is found with the mac, this is a new connect token. replace the oldest token entry.
-	if tokenIndex == -1 {
-		m.connectTokensEntries[oldestIndex].time = serverTime
-		m.connectTokensEntries[oldestIndex].address = addr
-		m.connectTokensEntries[oldestIndex].mac = connectTokenMac
-		log.Printf("new connect token added for %s\n", addr.String())
+		entry.time = serverTime
+		entry.address = addr
+		entry.expireTime = expireTime
+		copy(entry.mac, connectTokenMac)
+		if expireTime >= 0 {
+			m.tokenTimers.schedule(&entry.timer, expireTime)
+		} else {
+			m.tokenTimers.cancel(&entry.timer)
+		}
+		m.tokenAges.schedule(&entry.age, serverTime)
+		m.tokensByMac[mac] = oldestIndex
+		if logEnabled(m.logger, LogLevelDebug) {
+			m.logger.Log(LogLevelDebug, "new connect token added", fieldAddress(addr))
+		}
 		return true
 	}
 
@@ -236,38 +400,83 @@ func (m *ClientManager) FindOrAddTokenEntry(connectTokenMac []byte, addr *net.UD
 
 // Adds a new encryption mapping of client/server keys.
 func (m *ClientManager) AddEncryptionMapping(connectToken *ConnectTokenPrivate, addr *net.UDPAddr, serverTime, expireTime float64) bool {
+	key := newAddrKey(addr)
+
 	// already list
-	for i := 0; i < m.maxEntries; i += 1 {
+	if i, ok := m.cryptoByAddress[key]; ok {
 		entry := m.cryptoEntries[i]
 
 		lastAccessTimeout := entry.lastAccess + m.timeout
-		if entry.address != nil && addressEqual(entry.address, addr) && serverTimedout(lastAccessTimeout, serverTime) {
+		if serverTimedout(lastAccessTimeout, serverTime) {
 			entry.expireTime = expireTime
 			entry.lastAccess = serverTime
 			copy(entry.sendKey, connectToken.ServerKey)
 			copy(entry.recvKey, connectToken.ClientKey)
-			log.Printf("re-added encryption mapping for %s encIdx: %d\n", addr.String(), i)
+			m.cryptoTimers.schedule(&entry.timer, m.cryptoEntryDeadline(entry))
+			if logEnabled(m.logger, LogLevelDebug) {
+				m.logger.Log(LogLevelDebug, "re-added encryption mapping", fieldAddress(addr), LogField{"encryptionIndex", i})
+			}
 			return true
 		}
 	}
 
 	// not in our list.
+	i := m.findFreeCryptoEntry(serverTime)
+	if i == -1 {
+		return false
+	}
+
+	entry := m.cryptoEntries[i]
+	if entry.address != nil {
+		oldKey := newAddrKey(entry.address)
+		if index, ok := m.cryptoByAddress[oldKey]; ok && index == i {
+			delete(m.cryptoByAddress, oldKey)
+		}
+	}
+
+	entry.address = addr
+	entry.expireTime = expireTime
+	entry.lastAccess = serverTime
+	copy(entry.sendKey, connectToken.ServerKey)
+	copy(entry.recvKey, connectToken.ClientKey)
+	m.cryptoTimers.schedule(&entry.timer, m.cryptoEntryDeadline(entry))
+	m.cryptoByAddress[key] = i
+	if i+1 > m.numCryptoEntries {
+		m.numCryptoEntries = i + 1
+	}
+	return true
+}
+
+// returns a cleared encryption entry, or scans for one which has timed out or expired if
+// none have been cleared. Returns -1 if every entry is in use.
+func (m *ClientManager) findFreeCryptoEntry(serverTime float64) int {
+	for len(m.freeCryptoEntries) > 0 {
+		i := m.freeCryptoEntries[len(m.freeCryptoEntries)-1]
+		m.freeCryptoEntries = m.freeCryptoEntries[:len(m.freeCryptoEntries)-1]
+		if m.cryptoEntryFree(m.cryptoEntries[i], serverTime) {
+			return i
+		}
+	}
+
 	for i := 0; i < m.maxEntries; i += 1 {
-		entry := m.cryptoEntries[i]
-		if entry.lastAccess+m.timeout < serverTime || (entry.expireTime >= 0 && entry.expireTime < serverTime) {
-			entry.address = addr
-			entry.expireTime = expireTime
-			entry.lastAccess = serverTime
-			copy(entry.sendKey, connectToken.ServerKey)
-			copy(entry.recvKey, connectToken.ClientKey)
-			if i+1 > m.numCryptoEntries {
-				m.numCryptoEntries = i + 1
-			}
-			return true
+		if m.cryptoEntryFree(m.cryptoEntries[i], serverTime) {
+			return i
 		}
 	}
+	return -1
+}
 
-	return false
+func (m *ClientManager) cryptoEntryFree(entry *encryptionEntry, serverTime float64) bool {
+	return entry.lastAccess+m.timeout < serverTime || (entry.expireTime >= 0 && entry.expireTime < serverTime)
+}
+
+// the time after which cryptoEntryFree is true unless the entry is accessed again.
+func (m *ClientManager) cryptoEntryDeadline(entry *encryptionEntry) float64 {
+	deadline := entry.lastAccess + m.timeout
+	if entry.expireTime >= 0 && entry.expireTime < deadline {
+		return entry.expireTime
+	}
+	return deadline
 }
 
 // Update the encryption entry for the  provided encryption index.
@@ -290,36 +499,53 @@ func (m *ClientManager) SetEncryptionEntryExpiration(encryptionIndex int, expire
 		return false
 	}
 
-	m.cryptoEntries[encryptionIndex].expireTime = expireTime
+	entry := m.cryptoEntries[encryptionIndex]
+	entry.expireTime = expireTime
+	if entry.timer.index >= 0 {
+		m.cryptoTimers.schedule(&entry.timer, m.cryptoEntryDeadline(entry))
+	}
 	return true
 }
 
 // Removes the encryption entry for this UDPAddr.
 func (m *ClientManager) RemoveEncryptionEntry(addr *net.UDPAddr, serverTime float64) bool {
-	for i := 0; i < m.numCryptoEntries; i += 1 {
-		entry := m.cryptoEntries[i]
-		if !addressEqual(entry.address, addr) {
-			continue
-		}
+	if addr == nil {
+		return false
+	}
 
-		m.clearCryptoEntry(entry)
+	i, ok := m.cryptoByAddress[newAddrKey(addr)]
+	if !ok {
+		return false
+	}
 
-		if i+1 == m.numCryptoEntries {
-			index := i - 1
-			for index >= 0 {
-				lastAccessTimeout := m.cryptoEntries[index].lastAccess + m.timeout
-				if serverTimedout(lastAccessTimeout, serverTime) && (m.cryptoEntries[index].expireTime < 0 || m.cryptoEntries[index].expireTime > serverTime) {
-					break
-				}
-				index--
-			}
-			m.numCryptoEntries = index + 1
-		}
+	m.freeCryptoEntry(i, serverTime)
+	return true
+}
 
-		return true
+// clears the entry and makes it the next one reused by AddEncryptionMapping.
+func (m *ClientManager) freeCryptoEntry(i int, serverTime float64) {
+	entry := m.cryptoEntries[i]
+	if entry.address != nil {
+		key := newAddrKey(entry.address)
+		if index, ok := m.cryptoByAddress[key]; ok && index == i {
+			delete(m.cryptoByAddress, key)
+		}
 	}
+	m.cryptoTimers.cancel(&entry.timer)
+	m.clearCryptoEntry(entry)
+	m.freeCryptoEntries = append(m.freeCryptoEntries, i)
 
-	return false
+	if i+1 == m.numCryptoEntries {
+		index := i - 1
+		for index >= 0 {
+			lastAccessTimeout := m.cryptoEntries[index].lastAccess + m.timeout
+			if serverTimedout(lastAccessTimeout, serverTime) && (m.cryptoEntries[index].expireTime < 0 || m.cryptoEntries[index].expireTime > serverTime) {
+				break
+			}
+			index--
+		}
+		m.numCryptoEntries = index + 1
+	}
 }
 
 // Returns the encryption send key.
@@ -332,6 +558,34 @@ func (m *ClientManager) GetEncryptionEntryRecvKey(index int) []byte {
 	return m.getEncryptionEntryKey(index, false)
 }
 
+// sets the connect token sequence of the encryption entry, kept so it is available when the connection response arrives.
+func (m *ClientManager) setEncryptionEntryTokenSequence(index int, tokenSequence uint64) {
+	if index < 0 || index >= m.maxEntries {
+		return
+	}
+	m.cryptoEntries[index].tokenSequence = tokenSequence
+}
+
+func (m *ClientManager) getEncryptionEntryTokenSequence(index int) uint64 {
+	if index < 0 || index >= m.maxEntries {
+		return 0
+	}
+	return m.cryptoEntries[index].tokenSequence
+}
+
+// returns the cached cipher for the encryption entry's send or recv key, or nil if the index is invalid.
+func (m *ClientManager) getEncryptionEntryCrypto(index int, sendKey bool) *packetCrypto {
+	if index < 0 || index > m.numCryptoEntries || index >= m.maxEntries {
+		return nil
+	}
+
+	if sendKey {
+		return &m.cryptoEntries[index].sendCrypto
+	}
+
+	return &m.cryptoEntries[index].recvCrypto
+}
+
 func (m *ClientManager) getEncryptionEntryKey(index int, sendKey bool) []byte {
 	if index == -1 || index < 0 || index > m.numCryptoEntries {
 		return nil
@@ -346,12 +600,19 @@ func (m *ClientManager) getEncryptionEntryKey(index int, sendKey bool) []byte {
 
 func (m *ClientManager) sendPayloads(payloadData []byte, serverTime float64) {
 	for i := 0; i < m.maxClients; i += 1 {
-		m.sendPayloadToInstance(i, payloadData, serverTime)
+		m.sendPayloadToInstance(i, payloadData, serverTime, true)
 	}
+	m.flushWrites()
 }
 
-func (m *ClientManager) sendPayloadToInstance(index int, payloadData []byte, serverTime float64) {
+// sends the payload to the instance, if queue is set the packets are sent by the next flushWrites.
+func (m *ClientManager) sendPayloadToInstance(index int, payloadData []byte, serverTime float64, queue bool) {
 	instance := m.instances[index]
+	if instance.loopback {
+		m.sendPayloadToLoopback(instance, payloadData, serverTime)
+		return
+	}
+
 	if instance.encryptionIndex == -1 {
 		return
 	}
@@ -362,87 +623,171 @@ func (m *ClientManager) sendPayloadToInstance(index int, payloadData []byte, ser
 	}
 
 	if !instance.confirmed {
-		packet := &KeepAlivePacket{}
+		packet := &m.keepAlivePacket
 		packet.ClientIndex = uint32(instance.clientIndex)
 		packet.MaxClients = uint32(m.maxClients)
-		instance.SendPacket(packet, writePacketKey, serverTime)
+		m.writePacket(instance, packet, writePacketKey, serverTime, queue)
 	}
 
 	if instance.connected {
 		if !m.TouchEncryptionEntry(instance.encryptionIndex, instance.address, serverTime) {
-			log.Printf("error: encryption mapping is out of date for client %d\n", instance.clientIndex)
+			m.logger.Log(LogLevelError, "encryption mapping is out of date", fieldClientId(instance.clientId), fieldClientIndex(instance.clientIndex))
 			return
 		}
-		packet := NewPayloadPacket(payloadData)
-		instance.SendPacket(packet, writePacketKey, serverTime)
+		packet := &m.payloadPacket
+		packet.PayloadBytes = uint32(len(payloadData))
+		packet.PayloadData = payloadData
+		m.writePacket(instance, packet, writePacketKey, serverTime, queue)
+		packet.PayloadData = nil
+	}
+}
+
+// loopback clients have no socket or encryption, the payload is handed straight to the loopback handler.
+func (m *ClientManager) sendPayloadToLoopback(instance *ClientInstance, payloadData []byte, serverTime float64) {
+	if !instance.connected || m.loopbackHandlerFn == nil {
+		return
 	}
+
+	m.loopbackHandlerFn(instance.clientIndex, payloadData, instance.sequence)
+	instance.sequence++
+	instance.lastSendTime = serverTime
 }
 
-// Send keep alives to all connected clients.
+// Send keep alives to all connected clients which have not been sent a packet within the send rate.
 func (m *ClientManager) SendKeepAlives(serverTime float64) {
-	for i := 0; i < m.maxClients; i += 1 {
-		instance := m.instances[i]
-		if !instance.connected {
+	for _, t := range m.keepAliveTimers.popDue(serverTime) {
+		instance := m.instances[t.slot]
+		if !instance.connected || instance.loopback {
+			continue
+		}
+
+		shouldSendTime := instance.lastSendTime + float64(1.0/PACKET_SEND_RATE)
+		if shouldSendTime > serverTime && !floatEquals(shouldSendTime, serverTime) {
+			m.keepAliveTimers.schedule(t, shouldSendTime)
 			continue
 		}
+		m.keepAliveTimers.schedule(t, serverTime+float64(1.0/PACKET_SEND_RATE))
 
 		writePacketKey := m.GetEncryptionEntrySendKey(instance.encryptionIndex)
 		if bytes.Equal(writePacketKey, m.emptyWriteKey) || instance.address == nil {
 			continue
 		}
 
-		shouldSendTime := instance.lastSendTime + float64(1.0/PACKET_SEND_RATE)
-		if shouldSendTime < serverTime || floatEquals(shouldSendTime, serverTime) {
-			if !m.TouchEncryptionEntry(instance.encryptionIndex, instance.address, serverTime) {
-				log.Printf("error: encryption mapping is out of date for client %d\n", instance.clientIndex)
-				continue
-			}
+		if !m.TouchEncryptionEntry(instance.encryptionIndex, instance.address, serverTime) {
+			m.logger.Log(LogLevelError, "encryption mapping is out of date", fieldClientId(instance.clientId), fieldClientIndex(instance.clientIndex))
+			continue
+		}
+
+		packet := &m.keepAlivePacket
+		packet.ClientIndex = uint32(instance.clientIndex)
+		packet.MaxClients = uint32(m.maxClients)
+		m.writePacket(instance, packet, writePacketKey, serverTime, true)
+	}
+	m.flushWrites()
+}
 
-			packet := &KeepAlivePacket{}
-			packet.ClientIndex = uint32(instance.clientIndex)
-			packet.MaxClients = uint32(m.maxClients)
-			instance.SendPacket(packet, writePacketKey, serverTime)
+// writes the packet to the client, queued packets remember their socket for flushWrites.
+func (m *ClientManager) writePacket(instance *ClientInstance, packet Packet, writePacketKey []byte, serverTime float64, queue bool) {
+	instance.writePacket(packet, writePacketKey, m.getEncryptionEntryCrypto(instance.encryptionIndex, true), serverTime, queue)
+	if queue && instance.serverConn != nil && instance.serverConn.writeCount == 1 {
+		m.pendingConns = append(m.pendingConns, instance.serverConn)
+	}
+}
+
+// sends the packets queued on the client sockets.
+func (m *ClientManager) flushWrites() {
+	for _, conn := range m.pendingConns {
+		if conn.writeCount == 0 {
+			continue
+		}
+
+		if err := conn.flushWrites(); err != nil {
+			m.logger.Log(LogLevelError, "error flushing writes to clients", fieldError(err))
 		}
 	}
+	m.pendingConns = m.pendingConns[:0]
 }
 
-// Checks and disconnects any clients that have timed out.
+// Checks and disconnects any clients that have timed out, then sweeps expired encryption and
+// token entries.
 func (m *ClientManager) CheckTimeouts(serverTime float64) {
-	for i := 0; i < m.maxClients; i += 1 {
-		instance := m.instances[i]
+	for _, t := range m.timeoutTimers.popDue(serverTime) {
+		instance := m.instances[t.slot]
+		if !instance.connected || instance.loopback {
+			continue
+		}
+
 		timeout := instance.lastRecvTime + m.timeout
+		if timeout > serverTime && !floatEquals(timeout, serverTime) {
+			m.timeoutTimers.schedule(t, timeout)
+			continue
+		}
+
+		m.logger.Log(LogLevelInfo, "server timed out client", fieldClientId(instance.clientId), fieldClientIndex(t.slot), fieldAddress(instance.address))
+		m.disconnectClient(instance, false, serverTime, EventClientTimedOut)
+	}
+	m.sweepEntries(serverTime)
+}
+
+// frees encryption entries which have timed out or expired and token entries whose connect
+// token has expired.
+func (m *ClientManager) sweepEntries(serverTime float64) {
+	for _, t := range m.cryptoTimers.popDue(serverTime) {
+		entry := m.cryptoEntries[t.slot]
+		if !m.cryptoEntryFree(entry, serverTime) {
+			m.cryptoTimers.schedule(t, m.cryptoEntryDeadline(entry))
+			continue
+		}
+		m.freeCryptoEntry(t.slot, serverTime)
+	}
 
-		if instance.connected && (timeout < serverTime || floatEquals(timeout, serverTime)) {
-			log.Printf("server timed out client: %d\n", i)
-			m.disconnectClient(instance, false, serverTime)
+	for _, t := range m.tokenTimers.popDue(serverTime) {
+		entry := m.connectTokensEntries[t.slot]
+		var mac [MAC_BYTES]byte
+		copy(mac[:], entry.mac)
+		if index, ok := m.tokensByMac[mac]; ok && index == t.slot {
+			delete(m.tokensByMac, mac)
 		}
+		m.clearTokenEntry(entry)
+		m.tokenAges.cancel(&entry.age)
+		m.freeTokenEntries = append(m.freeTokenEntries, t.slot)
 	}
 }
 
 func (m *ClientManager) disconnectClients(serverTime float64) {
 	for clientIndex := 0; clientIndex < m.maxClients; clientIndex += 1 {
 		instance := m.instances[clientIndex]
-		m.disconnectClient(instance, true, serverTime)
+		m.disconnectClient(instance, true, serverTime, EventClientKicked)
 	}
 }
 
-func (m *ClientManager) disconnectClient(client *ClientInstance, sendDisconnect bool, serverTime float64) {
+// Disconnects the client, reason is the event type dispatched to the event handler.
+func (m *ClientManager) disconnectClient(client *ClientInstance, sendDisconnect bool, serverTime float64, reason ServerEventType) {
 	if !client.connected {
 		return
 	}
 
+	m.stats.removeConnected()
+	m.removeClientIndexes(client)
+	if client.loopback {
+		m.emitEvent(reason, client)
+		client.Clear()
+		return
+	}
+
 	if sendDisconnect {
 		packet := &DisconnectPacket{}
 		writePacketKey := m.GetEncryptionEntrySendKey(client.encryptionIndex)
 		if writePacketKey == nil {
-			log.Printf("error: unable to retrieve encryption key for client for disconnect: %d\n", client.clientId)
+			m.logger.Log(LogLevelError, "unable to retrieve encryption key for client disconnect", fieldClientId(client.clientId))
 		} else {
 			for i := 0; i < NUM_DISCONNECT_PACKETS; i += 1 {
-				client.SendPacket(packet, writePacketKey, serverTime)
+				m.writePacket(client, packet, writePacketKey, serverTime, false)
 			}
 		}
 	}
-	log.Printf("removing encryption entry for: %s", client.address.String())
+	m.emitEvent(reason, client)
+	m.logger.Log(LogLevelDebug, "removing encryption entry", fieldClientId(client.clientId), fieldAddress(client.address))
 	m.RemoveEncryptionEntry(client.address, serverTime)
 	client.Clear()
 }
@@ -460,3 +805,16 @@ func floatEquals(a, b float64) bool {
 func serverTimedout(lastAccessTimeout, serverTime float64) bool {
 	return (lastAccessTimeout > serverTime || floatEquals(lastAccessTimeout, serverTime))
 }
+
+// key for the address indexes. IPv4 addresses are stored in their IPv4-mapped form so they
+// match the same way addressEqual does.
+type addrKey struct {
+	ip   [net.IPv6len]byte
+	port int
+}
+
+func newAddrKey(addr *net.UDPAddr) addrKey {
+	key := addrKey{port: addr.Port}
+	copy(key.ip[:], addr.IP.To16())
+	return key
+}
@@ -1,6 +1,7 @@
 package netcode
 
 import (
+	"bytes"
 	"net"
 	"testing"
 )
@@ -124,7 +125,7 @@ func TestDisconnectClient(t *testing.T) {
 	}
 
 	token := NewChallengeToken(TEST_CLIENT_ID)
-	client := cm.ConnectClient(addr, token)
+	client := cm.ConnectClient(addr, token, serverTime)
 	clientIndex := cm.FindClientIndexById(TEST_CLIENT_ID)
 	if clientIndex == -1 {
 		t.Fatalf("error finding client index")
@@ -140,3 +141,161 @@ func TestDisconnectClient(t *testing.T) {
 	}
 
 }
+
+func TestClientManagerEvents(t *testing.T) {
+	timeout := float64(4)
+	maxClients := 2
+	servers := make([]net.UDPAddr, 1)
+	servers[0] = net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62424}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62425}
+	connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+
+	events := make([]*ServerEvent, 0)
+	cm := NewClientManager(timeout, maxClients)
+	cm.setEventHandler(func(event *ServerEvent) {
+		events = append(events, event)
+	})
+
+	serverTime := float64(1.0)
+	if !cm.AddEncryptionMapping(connectToken.PrivateData, addr, serverTime, serverTime+timeout) {
+		t.Fatalf("error adding encryption mapping\n")
+	}
+
+	token := NewChallengeToken(TEST_CLIENT_ID)
+	token.UserData.WriteBytes(connectToken.PrivateData.UserData)
+	cm.ConnectClient(addr, token, serverTime)
+
+	token2 := NewChallengeToken(TEST_CLIENT_ID + 1)
+	client2 := cm.ConnectClient(addr2, token2, serverTime)
+	client2.lastRecvTime = serverTime + timeout
+
+	// only the first client should time out
+	cm.CheckTimeouts(serverTime + timeout)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event got %d\n", len(events))
+	}
+
+	event := events[0]
+	if event.Type != EventClientTimedOut {
+		t.Fatalf("expected %s event got %s\n", EventClientTimedOut, event.Type)
+	}
+
+	if event.ClientId != TEST_CLIENT_ID || event.ClientIndex != 0 || !addressEqual(event.Address, addr) {
+		t.Fatalf("timed out event had wrong client details: %#v\n", event)
+	}
+
+	if !bytes.Equal(event.UserData, connectToken.PrivateData.UserData) {
+		t.Fatalf("timed out event user data did not match token user data\n")
+	}
+
+	cm.DisconnectClient(client2.clientIndex, false, serverTime)
+	if len(events) != 2 || events[1].Type != EventClientKicked || events[1].ClientId != TEST_CLIENT_ID+1 {
+		t.Fatalf("expected kicked event for second client\n")
+	}
+}
+
+func TestClientManagerIndexes(t *testing.T) {
+	timeout := float64(4)
+	maxClients := 2
+	servers := make([]net.UDPAddr, 1)
+	servers[0] = net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 62424}
+	mappedAddr := &net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 62424}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62425}
+	connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+
+	cm := NewClientManager(timeout, maxClients)
+
+	serverTime := float64(1.0)
+	if !cm.AddEncryptionMapping(connectToken.PrivateData, addr, serverTime, serverTime+timeout) {
+		t.Fatalf("error adding encryption mapping\n")
+	}
+
+	if cm.FindEncryptionEntryIndex(mappedAddr, serverTime) == -1 {
+		t.Fatalf("expected IPv4-mapped address to find the encryption entry\n")
+	}
+
+	client := cm.ConnectClient(addr, NewChallengeToken(TEST_CLIENT_ID), serverTime)
+	client2 := cm.ConnectClient(addr2, NewChallengeToken(TEST_CLIENT_ID+1), serverTime)
+	client2.lastRecvTime = serverTime + timeout
+
+	if cm.FindClientIndexByAddress(mappedAddr) != client.clientIndex || cm.FindClientIndexById(TEST_CLIENT_ID+1) != client2.clientIndex {
+		t.Fatalf("expected clients to be found by address and id\n")
+	}
+
+	if cm.ConnectedClientCount() != 2 {
+		t.Fatalf("expected 2 connected clients got %d\n", cm.ConnectedClientCount())
+	}
+
+	// first client times out, second is disconnected
+	cm.CheckTimeouts(serverTime + timeout)
+	if cm.FindClientIndexByAddress(addr) != -1 || cm.FindClientIndexById(TEST_CLIENT_ID) != -1 {
+		t.Fatalf("expected timed out client to be removed from the indexes\n")
+	}
+
+	if cm.FindEncryptionEntryIndex(addr, serverTime) != -1 {
+		t.Fatalf("expected timed out client encryption entry to be removed\n")
+	}
+
+	cm.DisconnectClient(client2.clientIndex, false, serverTime)
+	if cm.FindClientIndexByAddress(addr2) != -1 || cm.FindClientIndexById(TEST_CLIENT_ID+1) != -1 || cm.ConnectedClientCount() != 0 {
+		t.Fatalf("expected disconnected client to be removed from the indexes\n")
+	}
+
+	// reconnecting into a cleared slot is indexed again
+	client = cm.ConnectClient(addr2, NewChallengeToken(TEST_CLIENT_ID+2), serverTime)
+	if cm.FindClientIndexByAddress(addr2) != client.clientIndex || cm.FindClientIndexById(TEST_CLIENT_ID+2) != client.clientIndex || cm.ConnectedClientCount() != 1 {
+		t.Fatalf("expected reconnected client to be indexed\n")
+	}
+}
+
+func TestFindOrAddTokenEntryEvictsOldest(t *testing.T) {
+	cm := NewClientManager(float64(4), 1)
+	addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62424}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62425}
+
+	macs := make([][]byte, cm.maxEntries+1)
+	for i := range macs {
+		macs[i] = make([]byte, MAC_BYTES)
+		macs[i][0] = byte(i + 1)
+		if !cm.FindOrAddTokenEntry(macs[i][:], addr, float64(i)) {
+			t.Fatalf("expected token entry %d to be added\n", i)
+		}
+	}
+
+	// the first mac was the oldest so it was replaced, the second is still held for addr
+	if !cm.FindOrAddTokenEntry(macs[0], addr2, float64(len(macs))) {
+		t.Fatalf("expected oldest token entry to have been evicted\n")
+	}
+
+	if cm.FindOrAddTokenEntry(macs[2], addr2, float64(len(macs))) {
+		t.Fatalf("expected token entry to be rejected for a different address\n")
+	}
+
+	if !cm.FindOrAddTokenEntry(macs[len(macs)-1], addr, float64(len(macs))) {
+		t.Fatalf("expected token entry to be accepted for the same address\n")
+	}
+
+	// the entry with the earliest time is replaced even when it was added last
+	cm = NewClientManager(float64(4), 1)
+	for i := range macs[:cm.maxEntries] {
+		if !cm.FindOrAddTokenEntry(macs[i], addr, float64(cm.maxEntries-i)) {
+			t.Fatalf("expected token entry %d to be added\n", i)
+		}
+	}
+
+	if !cm.FindOrAddTokenEntry(macs[len(macs)-1], addr, float64(len(macs))) {
+		t.Fatalf("expected new token entry to be added\n")
+	}
+
+	if !cm.FindOrAddTokenEntry(macs[cm.maxEntries-1], addr2, float64(len(macs))) {
+		t.Fatalf("expected token entry with the earliest time to have been evicted\n")
+	}
+
+	if cm.FindOrAddTokenEntry(macs[0], addr2, float64(len(macs))) {
+		t.Fatalf("expected newer token entry to be rejected for a different address\n")
+	}
+}
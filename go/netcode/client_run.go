@@ -0,0 +1,138 @@
+package netcode
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const CLIENT_STATE_QUEUE_SIZE = 16 // number of state changes buffered for the States channel
+
+// A payload recv'd from the server while the client is driven by Run.
+type ClientPayload struct {
+	Sequence uint64
+	Data     []byte
+}
+
+// Sets the number of ticks per second used by Run, values below PACKET_SEND_RATE are raised
+// to PACKET_SEND_RATE so keep-alives are never delayed.
+func (c *Client) SetTickRate(ticksPerSecond float64) {
+	if ticksPerSecond < PACKET_SEND_RATE {
+		ticksPerSecond = PACKET_SEND_RATE
+	}
+	c.tickRate = ticksPerSecond
+}
+
+// Returns the channel payloads are delivered on while the client is driven by Run.
+// The channel is closed when Run returns.
+func (c *Client) Payloads() <-chan *ClientPayload {
+	return c.payloadCh
+}
+
+// Returns the channel every state change is delivered on while the client is driven by Run.
+// The channel is closed when Run returns.
+func (c *Client) States() <-chan ClientState {
+	return c.stateCh
+}
+
+// queues the payload to be sent on the next tick, used by SendData while driven by Run.
+func (c *Client) queueSend(payloadData []byte) error {
+	if len(payloadData) > MAX_PAYLOAD_BYTES {
+		return errors.New("payload is too large")
+	}
+
+	data := make([]byte, len(payloadData))
+	copy(data, payloadData)
+
+	select {
+	case c.sendCh <- data:
+		return nil
+	default:
+		return errors.New("client send queue is full")
+	}
+}
+
+// Drives the client at the tick rate until the context is cancelled or the client is
+// disconnected. Connect or ConnectLoopback must be called prior to Run. On cancellation the
+// client sends disconnect packets and closes its connection. While running, SendData may be
+// called from any goroutine, all other methods must not be called until Run returns.
+// Payloads and state changes must be drained by the caller or the tick will block.
+func (c *Client) Run(ctx context.Context) error {
+	if c.GetState() <= StateDisconnected {
+		return errors.New("client is not connected or connecting, Connect must be called before Run")
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.runState, 0, 1) {
+		return errors.New("client is already being driven by Run")
+	}
+
+	defer func() {
+		atomic.StoreInt32(&c.runState, 2)
+		close(c.payloadCh)
+		close(c.stateCh)
+	}()
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / c.tickRate))
+	defer ticker.Stop()
+
+	// the system clock's times carry a monotonic reading, so client time is unaffected by wall clock changes.
+	startTime := c.clock.Now()
+	baseTime := c.time
+	for {
+		select {
+		case <-ctx.Done():
+			c.Disconnect(StateDisconnected, true)
+			c.Close()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		c.tick(ctx, baseTime+c.clock.Now().Sub(startTime).Seconds())
+		if c.GetState() <= StateDisconnected {
+			c.Close()
+			return nil
+		}
+	}
+}
+
+// a single iteration of Run, updates the client, applies queued sends then delivers
+// state changes and payloads.
+func (c *Client) tick(ctx context.Context, t float64) {
+	c.Update(t)
+
+	for sending := true; sending; {
+		select {
+		case payloadData := <-c.sendCh:
+			if err := c.sendData(payloadData); err != nil {
+				if logEnabled(c.logger, LogLevelDebug) {
+					c.logger.Log(LogLevelDebug, "client dropped queued payload", c.fieldId(), fieldError(err))
+				}
+			}
+		default:
+			sending = false
+		}
+	}
+
+	for _, state := range c.stateChanges {
+		select {
+		case c.stateCh <- state:
+		case <-ctx.Done():
+			return
+		}
+	}
+	c.stateChanges = c.stateChanges[:0]
+
+	for {
+		payloadData, sequence := c.RecvData()
+		if payloadData == nil {
+			return
+		}
+
+		select {
+		case c.payloadCh <- &ClientPayload{Sequence: sequence, Data: payloadData}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
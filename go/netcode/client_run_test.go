@@ -0,0 +1,100 @@
+package netcode
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientRun(t *testing.T) {
+	maxClients := 4
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40002}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, maxClients)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	servDoneCh := make(chan struct{})
+	go func() {
+		defer close(servDoneCh)
+		serv.Run(ctx)
+	}()
+
+	// echo every payload back to its sender
+	go func() {
+		for payload := range serv.Payloads() {
+			serv.Send(payload.ClientId, payload.Data)
+		}
+	}()
+	go func() {
+		for range serv.Events() {
+		}
+	}()
+
+	servers := []net.UDPAddr{addr}
+	connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+	client := NewClient(connectToken)
+	client.SetTickRate(1)
+	if client.tickRate != PACKET_SEND_RATE {
+		t.Fatalf("expected tick rate to be raised to %f got %f\n", PACKET_SEND_RATE, client.tickRate)
+	}
+	client.SetTickRate(DEFAULT_TICK_RATE)
+
+	if err := client.Run(ctx); err == nil {
+		t.Fatalf("expected error running client before Connect\n")
+	}
+
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+
+	clientCtx, clientCancel := context.WithCancel(ctx)
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- client.Run(clientCtx)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for connected := false; !connected; {
+		select {
+		case state := <-client.States():
+			connected = state == StateConnected
+		case <-timeout:
+			t.Fatalf("timed out waiting for client to connect\n")
+		}
+	}
+
+	// SendData is called from a different goroutine than Run
+	if err := client.SendData([]byte("ping")); err != nil {
+		t.Fatalf("error sending data: %s\n", err)
+	}
+
+	select {
+	case payload := <-client.Payloads():
+		if string(payload.Data) != "ping" {
+			t.Fatalf("expected echoed ping got: %s\n", payload.Data)
+		}
+	case <-timeout:
+		t.Fatalf("timed out waiting for echoed payload\n")
+	}
+
+	clientCancel()
+	if err := <-runErrCh; err != context.Canceled {
+		t.Fatalf("expected context.Canceled from Run got: %v\n", err)
+	}
+
+	if client.GetState() != StateDisconnected {
+		t.Fatalf("expected client to be disconnected got: %s\n", clientStateMap[client.GetState()])
+	}
+
+	cancel()
+	<-servDoneCh
+}
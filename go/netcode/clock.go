@@ -0,0 +1,61 @@
+package netcode
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of wall clock time for connect token timestamps and expiry, rate limits,
+// bans, key ring activation, the Run loops and NetworkSimulator delays. Servers and clients use
+// the system clock unless one is set, a ManualClock makes all of these deterministic in tests.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Returns the clock reading the system time.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// returns the system clock if clock is nil.
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return systemClock{}
+	}
+	return clock
+}
+
+// A Clock which only moves when it is advanced, safe to use from any goroutine.
+type ManualClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	c.now = c.now.Add(d)
+	c.mutex.Unlock()
+}
+
+func (c *ManualClock) Set(now time.Time) {
+	c.mutex.Lock()
+	c.now = now
+	c.mutex.Unlock()
+}
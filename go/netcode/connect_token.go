@@ -31,7 +31,13 @@ func NewConnectToken() *ConnectToken {
 // Generates the token and private token data with the supplied config values and sequence id.
 // This will also write and encrypt the private token
 func (token *ConnectToken) Generate(clientId uint64, serverAddrs []net.UDPAddr, versionInfo string, protocolId uint64, expireSeconds uint64, timeoutSeconds int32, sequence uint64, userData, privateKey []byte) error {
-	token.CreateTimestamp = uint64(time.Now().Unix())
+	return token.GenerateAt(time.Now(), clientId, serverAddrs, versionInfo, protocolId, expireSeconds, timeoutSeconds, sequence, userData, privateKey)
+}
+
+// Generates the token as Generate does, created at now rather than the system time so
+// tokens can be made for a Clock other than the system clock.
+func (token *ConnectToken) GenerateAt(now time.Time, clientId uint64, serverAddrs []net.UDPAddr, versionInfo string, protocolId uint64, expireSeconds uint64, timeoutSeconds int32, sequence uint64, userData, privateKey []byte) error {
+	token.CreateTimestamp = uint64(now.Unix())
 	token.ExpireTimestamp = token.CreateTimestamp + (expireSeconds * 1000)
 	token.TimeoutSeconds = timeoutSeconds
 	token.VersionInfo = []byte(VERSION_INFO)
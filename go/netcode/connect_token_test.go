@@ -75,7 +75,7 @@ func TestConnectToken(t *testing.T) {
 
 }
 
-func testGenerateConnectToken(servers []net.UDPAddr, privateKey []byte, t *testing.T) *ConnectToken {
+func testGenerateConnectToken(servers []net.UDPAddr, privateKey []byte, t testing.TB) *ConnectToken {
 	if privateKey == nil {
 		privateKey = TEST_PRIVATE_KEY
 	}
@@ -1,6 +1,8 @@
 package netcode
 
 import (
+	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
 	"golang.org/x/crypto/chacha20poly1305"
 )
@@ -37,3 +39,70 @@ func DecryptAead(message []byte, additional, nonce, key []byte) ([]byte, error)
 	message, err = aead.Open(message[:0], nonce, message, additional)
 	return message, err
 }
+
+// A ChaCha20-Poly1305 instance cached for a session key, with scratch space for the nonce and
+// additional data so encrypting and decrypting packets does not allocate. Not safe for concurrent use.
+type packetCrypto struct {
+	key        [KEY_BYTES]byte
+	aead       cipher.AEAD
+	nonce      [SizeUint32 + SizeUint64]byte
+	additional [VERSION_INFO_BYTES + SizeUint64 + SizeUint8]byte
+}
+
+// Returns the cipher for the key, a new one is only created when the key has changed.
+func (c *packetCrypto) cipher(key []byte) (cipher.AEAD, error) {
+	if c.aead != nil && bytes.Equal(c.key[:], key) {
+		return c.aead, nil
+	}
+
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	copy(c.key[:], key)
+	c.aead = aead
+	return aead, nil
+}
+
+// Drops the cached cipher and key, called when the session's keys are cleared.
+func (c *packetCrypto) reset() {
+	c.aead = nil
+	for i := range c.key {
+		c.key[i] = 0
+	}
+}
+
+// Sets the per-packet nonce and the additional data of the version, protocol id and prefix byte.
+// These must match to decrypt.
+func (c *packetCrypto) cryptData(prefixByte uint8, protocolId, sequence uint64) ([]byte, []byte) {
+	additionalData := Buffer{Buf: c.additional[:]}
+	additionalData.WriteBytesN([]byte(VERSION_INFO), VERSION_INFO_BYTES)
+	additionalData.WriteUint64(protocolId)
+	additionalData.WriteUint8(prefixByte)
+
+	nonce := Buffer{Buf: c.nonce[:]}
+	nonce.WriteUint32(0)
+	nonce.WriteUint64(sequence)
+	return additionalData.Buf, nonce.Buf
+}
+
+// Encrypts the packet data in place, the MAC is written after it.
+func (c *packetCrypto) seal(message []byte, prefixByte uint8, protocolId, sequence uint64, key []byte) error {
+	aead, err := c.cipher(key)
+	if err != nil {
+		return err
+	}
+	additionalData, nonce := c.cryptData(prefixByte, protocolId, sequence)
+	aead.Seal(message[:0], nonce, message, additionalData)
+	return nil
+}
+
+// Decrypts the packet data in place, returning the decrypted data without the MAC.
+func (c *packetCrypto) open(message []byte, prefixByte uint8, protocolId, sequence uint64, key []byte) ([]byte, error) {
+	aead, err := c.cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	additionalData, nonce := c.cryptData(prefixByte, protocolId, sequence)
+	return aead.Open(message[:0], nonce, message, additionalData)
+}
@@ -0,0 +1,130 @@
+package netcode
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPacketCryptoCache(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	payload := NewPayloadPacket(make([]byte, 256))
+	expected := make([]byte, MAX_PACKET_BYTES)
+	expectedBytes, err := payload.Write(expected, TEST_PROTOCOL_ID, 1, key)
+	if err != nil {
+		t.Fatalf("error writing payload packet: %s\n", err)
+	}
+
+	crypto := &packetCrypto{}
+	buf := make([]byte, MAX_PACKET_BYTES)
+	for i := 0; i < 2; i += 1 {
+		n, err := payload.write(buf, TEST_PROTOCOL_ID, 1, key, crypto)
+		if err != nil {
+			t.Fatalf("error writing payload packet: %s\n", err)
+		}
+
+		if !bytes.Equal(buf[:n], expected[:expectedBytes]) {
+			t.Fatalf("expected cached cipher to write the same packet as a new cipher\n")
+		}
+	}
+
+	read := &PayloadPacket{}
+	if err := read.read(buf, expectedBytes, TEST_PROTOCOL_ID, key, packetAllowedAll(), nil, crypto); err != nil {
+		t.Fatalf("error reading payload packet with cached cipher: %s\n", err)
+	}
+
+	// a new key must not use the cipher cached for the old one
+	otherKey, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	if _, err := payload.write(buf, TEST_PROTOCOL_ID, 1, otherKey, crypto); err != nil {
+		t.Fatalf("error writing payload packet: %s\n", err)
+	}
+
+	if err := read.Read(buf, expectedBytes, TEST_PROTOCOL_ID, 0, key, nil, packetAllowedAll(), nil); err == nil {
+		t.Fatalf("expected packet written with a new key not to decrypt with the old key\n")
+	}
+
+	crypto.reset()
+	if crypto.aead != nil || !bytes.Equal(crypto.key[:], make([]byte, KEY_BYTES)) {
+		t.Fatalf("expected reset to drop the cached cipher and key\n")
+	}
+}
+
+func TestClearCryptoEntryResetsCipher(t *testing.T) {
+	cm := NewClientManager(float64(4), 1)
+	entry := cm.cryptoEntries[0]
+	if _, err := entry.sendCrypto.cipher(TEST_PRIVATE_KEY); err != nil {
+		t.Fatalf("error creating cipher: %s\n", err)
+	}
+
+	cm.clearCryptoEntry(entry)
+	if entry.sendCrypto.aead != nil || entry.recvCrypto.aead != nil {
+		t.Fatalf("expected clearing the encryption entry to drop its ciphers\n")
+	}
+}
+
+func packetAllowedAll() []byte {
+	allowed := make([]byte, ConnectionNumPackets)
+	for i := range allowed {
+		allowed[i] = 1
+	}
+	return allowed
+}
+
+func BenchmarkEncryptPacket(b *testing.B) {
+	benchmarkEncryptPacket(b, nil)
+}
+
+func BenchmarkEncryptPacketCached(b *testing.B) {
+	benchmarkEncryptPacket(b, &packetCrypto{})
+}
+
+func BenchmarkDecryptPacket(b *testing.B) {
+	benchmarkDecryptPacket(b, nil)
+}
+
+func BenchmarkDecryptPacketCached(b *testing.B) {
+	benchmarkDecryptPacket(b, &packetCrypto{})
+}
+
+func benchmarkEncryptPacket(b *testing.B, crypto *packetCrypto) {
+	payload := NewPayloadPacket(make([]byte, 1024))
+	buf := make([]byte, MAX_PACKET_BYTES)
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		if _, err := payload.write(buf, TEST_PROTOCOL_ID, uint64(i), TEST_PRIVATE_KEY, crypto); err != nil {
+			b.Fatalf("error writing payload packet: %s\n", err)
+		}
+	}
+}
+
+func benchmarkDecryptPacket(b *testing.B, crypto *packetCrypto) {
+	packetData := make([]byte, MAX_PACKET_BYTES)
+	packetBytes, err := NewPayloadPacket(make([]byte, 1024)).Write(packetData, TEST_PROTOCOL_ID, 1, TEST_PRIVATE_KEY)
+	if err != nil {
+		b.Fatalf("error writing payload packet: %s\n", err)
+	}
+
+	allowed := packetAllowedAll()
+	buf := make([]byte, MAX_PACKET_BYTES)
+	read := &PayloadPacket{}
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		// decryption is in place
+		copy(buf, packetData[:packetBytes])
+		read.PayloadData = read.PayloadData[:0]
+		if err := read.read(buf, packetBytes, TEST_PROTOCOL_ID, TEST_PRIVATE_KEY, allowed, nil, crypto); err != nil {
+			b.Fatalf("error reading payload packet: %s\n", err)
+		}
+	}
+}
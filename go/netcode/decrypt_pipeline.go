@@ -0,0 +1,198 @@
+package netcode
+
+import (
+	"errors"
+	"sync"
+)
+
+// A datagram read this tick. Packets from connected clients are decrypted and checked against
+// the client's replay protection on a worker, everything else is processed by onPacketData.
+type decryptJob struct {
+	recv *NetcodeData
+
+	// set when the datagram is from a connected client and decrypted on a worker
+	client           *ClientInstance
+	clientId         uint64
+	encryptionIndex  int
+	readPacketKey    []byte
+	readCrypto       *packetCrypto
+	replayProtection *ReplayProtection
+
+	packet Packet
+	err    error
+}
+
+// Decrypts packets from connected clients on a pool of workers. Every packet from a client slot
+// goes to the same worker in the order it arrived, so a client's replay protection is only ever
+// used by one goroutine at a time. Update waits for the workers then processes every packet in
+// arrival order, so the client manager is still only accessed from Update.
+type decryptPipeline struct {
+	workers []chan *decryptJob
+	wg      sync.WaitGroup
+
+	jobs    []*decryptJob // reused between ticks
+	numJobs int
+
+	protocolId     uint64
+	allowedPackets []byte
+	timestamp      uint64 // unix time the tick's packets are checked against
+}
+
+func newDecryptPipeline(count, queueSize int) *decryptPipeline {
+	p := &decryptPipeline{}
+	p.workers = make([]chan *decryptJob, count)
+	for i := range p.workers {
+		p.workers[i] = make(chan *decryptJob, queueSize/count+1)
+	}
+	return p
+}
+
+func (p *decryptPipeline) start() {
+	for _, jobs := range p.workers {
+		go p.work(jobs)
+	}
+}
+
+func (p *decryptPipeline) stop() {
+	for _, jobs := range p.workers {
+		close(jobs)
+	}
+}
+
+func (p *decryptPipeline) work(jobs chan *decryptJob) {
+	for job := range jobs {
+		packetData := job.recv.data
+		job.packet = newPooledPacket(packetData)
+		job.err = readSessionPacket(job.packet, packetData, len(packetData), p.protocolId, p.timestamp, job.readPacketKey, nil, p.allowedPackets, job.replayProtection, job.readCrypto)
+		p.wg.Done()
+	}
+}
+
+// returns the next job for this tick, allocating one only when the tick has more packets than
+// any tick before it.
+func (p *decryptPipeline) nextJob(recv *NetcodeData) *decryptJob {
+	if p.numJobs == len(p.jobs) {
+		p.jobs = append(p.jobs, &decryptJob{})
+	}
+	job := p.jobs[p.numJobs]
+	p.numJobs++
+	job.recv = recv
+	return job
+}
+
+func (p *decryptPipeline) reset() {
+	for _, job := range p.jobs[:p.numJobs] {
+		*job = decryptJob{}
+	}
+	p.numJobs = 0
+}
+
+// Sets the number of goroutines packets from connected clients are decrypted on, 0 or 1 decrypts
+// packets serially in Update. Connection requests and responses are always processed in Update.
+// Must be called before Listen.
+func (s *Server) SetDecryptWorkers(count int) error {
+	if count < 0 {
+		return errors.New("decrypt worker count must not be negative")
+	}
+
+	if s.running {
+		return errors.New("decrypt workers must be set before the server is listening")
+	}
+
+	s.decryptWorkers = count
+	return nil
+}
+
+// drains the packet channel, handing packets from connected clients to the decrypt workers, then
+// processes every packet in the order it was read once the workers are done.
+func (s *Server) readPipelined() {
+	p := s.decrypt
+	p.protocolId = s.protocolId
+	p.allowedPackets = s.allowedPackets
+	p.timestamp = uint64(s.clock.Now().Unix())
+
+	for {
+		select {
+		case recv := <-s.packetCh:
+			s.prepareDecrypt(p.nextJob(recv))
+		default:
+			goto DISPATCHED
+		}
+	}
+DISPATCHED:
+	p.wg.Wait()
+
+	for _, job := range p.jobs[:p.numJobs] {
+		if job.client == nil {
+			s.onPacketData(job.recv.data, job.recv.from, job.recv.conn)
+		} else {
+			s.processDecrypted(job)
+		}
+		job.recv.release()
+	}
+	p.reset()
+}
+
+// looks up the sender and, if it is a connected client, sends the job to the client slot's worker.
+func (s *Server) prepareDecrypt(job *decryptJob) {
+	packetType := PacketType(0).Peek(job.recv.data)
+	if packetType == ConnectionRequest || packetType == ConnectionResponse {
+		return
+	}
+
+	clientIndex := s.clientManager.FindClientIndexByAddress(job.recv.from)
+	if clientIndex == -1 {
+		return
+	}
+
+	client := s.clientManager.instances[clientIndex]
+	job.client = client
+	job.clientId = client.clientId
+	job.encryptionIndex = client.encryptionIndex
+	job.readPacketKey = s.clientManager.GetEncryptionEntryRecvKey(client.encryptionIndex)
+	job.readCrypto = s.clientManager.getEncryptionEntryCrypto(client.encryptionIndex, false)
+	job.replayProtection = client.replayProtection
+
+	s.decrypt.wg.Add(1)
+	s.decrypt.workers[clientIndex%len(s.decrypt.workers)] <- job
+}
+
+// processes a packet decrypted on a worker, the same as onPacketData does after reading it.
+func (s *Server) processDecrypted(job *decryptJob) {
+	if !s.running {
+		releasePacket(job.packet)
+		return
+	}
+
+	s.recvConn = job.recv.conn
+	size := len(job.recv.data)
+	s.stats.addReceived(size)
+
+	// an earlier packet this tick may have disconnected the client or reused its slot
+	client := job.client
+	if !client.connected || client.clientId != job.clientId || client.encryptionIndex != job.encryptionIndex || !addressEqual(client.address, job.recv.from) {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server dropped packet. client disconnected before it was processed", fieldClientId(job.clientId), fieldAddress(job.recv.from))
+		}
+		releasePacket(job.packet)
+		return
+	}
+	client.stats.addReceived(size)
+
+	if job.err != nil {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server error reading packet", fieldAddress(job.recv.from), fieldError(job.err))
+		}
+		s.stats.addReadError(job.err)
+		client.stats.addReadError(job.err)
+		releasePacket(job.packet)
+		return
+	}
+
+	s.processPacket(client.clientIndex, job.encryptionIndex, job.packet, job.recv.from)
+
+	// payloads are owned by the client's packet queue
+	if job.packet.GetType() != ConnectionPayload {
+		releasePacket(job.packet)
+	}
+}
@@ -0,0 +1,90 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerDecryptWorkers(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40010}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 8)
+	if err := serv.SetDecryptWorkers(-1); err == nil {
+		t.Fatalf("expected error setting negative decrypt workers\n")
+	}
+
+	if err := serv.SetDecryptWorkers(4); err != nil {
+		t.Fatalf("error setting decrypt workers: %s\n", err)
+	}
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	if err := serv.SetDecryptWorkers(2); err == nil {
+		t.Fatalf("expected error setting decrypt workers while listening\n")
+	}
+
+	clients := make([]*Client, 6)
+	for i := range clients {
+		connectToken := NewConnectToken()
+		if err := connectToken.Generate(TEST_CLIENT_ID+uint64(i), []net.UDPAddr{addr}, VERSION_INFO, TEST_PROTOCOL_ID, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_SEQUENCE_START, make([]byte, USER_DATA_BYTES), TEST_PRIVATE_KEY); err != nil {
+			t.Fatalf("error generating connect token: %s\n", err)
+		}
+
+		clients[i] = NewClient(connectToken)
+		if err := clients[i].Connect(); err != nil {
+			t.Fatalf("error connecting: %s\n", err)
+		}
+		defer clients[i].Close()
+	}
+
+	// payloads must arrive in order, as a client's packets are always decrypted on the same worker
+	const numPayloads = 50
+	sent := make([]int, len(clients))
+	next := make([]int, len(clients))
+	clientTime := float64(0)
+	for i := 0; i < 500; i += 1 {
+		serv.Update(serv.serverTime + 0.01)
+		for _, instance := range serv.clientManager.instances {
+			if !instance.connected {
+				continue
+			}
+
+			for {
+				data, _ := serv.RecvPayload(instance.clientIndex)
+				if len(data) == 0 {
+					break
+				}
+
+				index := int(instance.clientId - TEST_CLIENT_ID)
+				if int(data[0]) < next[index] {
+					t.Fatalf("client %d payload %d arrived out of order, expected at least %d\n", index, data[0], next[index])
+				}
+				next[index] = int(data[0]) + 1
+			}
+		}
+
+		done := true
+		for j, client := range clients {
+			client.Update(clientTime)
+			for k := 0; k < 5 && client.GetState() == StateConnected && sent[j] < numPayloads; k += 1 {
+				client.SendData([]byte{byte(sent[j]), 0, 0, 0})
+				sent[j]++
+			}
+			done = done && next[j] == numPayloads
+		}
+
+		if done {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+	}
+	t.Fatalf("expected every client to deliver %d payloads got %v\n", numPayloads, next)
+}
@@ -0,0 +1,109 @@
+package netcode
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// A pending call to Drain, picked up and completed by Update.
+type drainRequest struct {
+	ctx      context.Context
+	doneCh   chan struct{}
+	err      error
+	complete bool // set once Update has finished draining, otherwise Stop was called first
+}
+
+// Puts the server into drain mode: new connection requests and responses are answered with
+// a denied packet while connected clients continue as normal. Once the last client leaves,
+// or the context is done, remaining clients are kicked, an EventServerDrained event is
+// emitted and the server is stopped. Drain blocks until then so it must be called from a
+// different goroutine than Update, and returns early with the context's error once the
+// context is done, even if Update is not running. Returns the context's error if clients
+// were kicked.
+func (s *Server) Drain(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return errors.New("server is already draining")
+	}
+
+	// only the call which set draining queues a request, so this never blocks
+	request := &drainRequest{ctx: ctx, doneCh: make(chan struct{})}
+	s.drainCh <- request
+
+	select {
+	case <-request.doneCh:
+	case <-s.shutdownCh:
+		// Stop completes a picked up request before closing shutdownCh
+		select {
+		case <-request.doneCh:
+		default:
+			// the server was already stopped, take the request back
+			select {
+			case <-s.drainCh:
+				atomic.StoreInt32(&s.draining, 0)
+			default:
+			}
+			return errors.New("server stopped before draining completed")
+		}
+	case <-ctx.Done():
+		// Update kicks the remaining clients on its next tick, or Stop clears the request
+		select {
+		case <-request.doneCh:
+		default:
+			return ctx.Err()
+		}
+	}
+	return request.err
+}
+
+// Returns true from when Drain is called until the server is stopped, safe to call from any goroutine.
+func (s *Server) IsDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+// called from Update, stops the server once draining has completed.
+func (s *Server) checkDrain() {
+	if s.drain == nil {
+		select {
+		case s.drain = <-s.drainCh:
+			s.logger.Log(LogLevelInfo, "server draining", LogField{"clients", s.clientManager.ConnectedClientCount()})
+		default:
+			return
+		}
+	}
+
+	if s.clientManager.ConnectedClientCount() > 0 {
+		if s.drain.ctx.Err() == nil {
+			return
+		}
+		s.drain.err = s.drain.ctx.Err()
+		s.logger.Log(LogLevelInfo, "server drain deadline reached, kicking remaining clients", LogField{"clients", s.clientManager.ConnectedClientCount()})
+		s.clientManager.disconnectClients(s.serverTime)
+	}
+
+	s.logger.Log(LogLevelInfo, "server drained")
+	if s.clientManager.eventHandlerFn != nil {
+		s.clientManager.eventHandlerFn(&ServerEvent{Type: EventServerDrained, ClientIndex: -1})
+	}
+	s.drain.complete = true
+	s.Stop()
+}
+
+// completes the in progress Drain call, if any, and clears draining. Called from Stop, a stopped
+// server cannot be listened on again so later Drain calls return an error.
+func (s *Server) finishDrain() {
+	defer atomic.StoreInt32(&s.draining, 0)
+	if s.drain == nil {
+		select {
+		case s.drain = <-s.drainCh:
+		default:
+			return
+		}
+	}
+
+	if !s.drain.complete {
+		s.drain.err = errors.New("server stopped before draining completed")
+	}
+	close(s.drain.doneCh)
+	s.drain = nil
+}
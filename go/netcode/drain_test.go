@@ -0,0 +1,161 @@
+package netcode
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerDrain(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40005}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	events := make([]ServerEventType, 0)
+	serv.SetEventHandler(func(event *ServerEvent) {
+		events = append(events, event.Type)
+	})
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	serv.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {})
+	if err := serv.ConnectLoopbackClient(0, TEST_CLIENT_ID+1, nil); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- serv.Drain(context.Background())
+	}()
+
+	for !serv.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// new clients are denied while the loopback client keeps the server from draining
+	client := NewClient(testGenerateConnectToken([]net.UDPAddr{addr}, TEST_PRIVATE_KEY, t))
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	defer client.Close()
+
+	clientTime := float64(0)
+	for i := 0; i < 200 && client.GetState() > StateDisconnected; i += 1 {
+		client.Update(clientTime)
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+		if err := serv.Update(serv.serverTime + 0.01); err != nil {
+			t.Fatalf("server stopped before drained: %s\n", err)
+		}
+	}
+
+	if client.GetState() != StateConnectionDenied {
+		t.Fatalf("expected client to be denied got: %s\n", clientStateMap[client.GetState()])
+	}
+
+	if err := serv.DisconnectLoopbackClient(0); err != nil {
+		t.Fatalf("error disconnecting loopback client: %s\n", err)
+	}
+	serv.Update(serv.serverTime + 0.01)
+
+	if err := <-drainErrCh; err != nil {
+		t.Fatalf("expected drain to complete without error got: %s\n", err)
+	}
+
+	if serv.running || events[len(events)-1] != EventServerDrained {
+		t.Fatalf("expected server to be stopped after emitting drained event\n")
+	}
+
+	if err := serv.Drain(context.Background()); err == nil {
+		t.Fatalf("expected error draining stopped server\n")
+	}
+
+	if serv.IsDraining() {
+		t.Fatalf("expected stopped server to no longer be draining\n")
+	}
+}
+
+func TestServerDrainNotRunning(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	// Update never runs so the context ends the wait
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := serv.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded got: %v\n", err)
+	}
+
+	if !serv.IsDraining() {
+		t.Fatalf("expected server to be draining until stopped\n")
+	}
+
+	if err := serv.Drain(context.Background()); err == nil {
+		t.Fatalf("expected error draining twice\n")
+	}
+
+	serv.Stop()
+	if serv.IsDraining() {
+		t.Fatalf("expected stop to clear draining\n")
+	}
+}
+
+func TestServerDrainDeadline(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	events := make([]ServerEventType, 0)
+	serv.SetEventHandler(func(event *ServerEvent) {
+		events = append(events, event.Type)
+	})
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	serv.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {})
+	if err := serv.ConnectLoopbackClient(0, TEST_CLIENT_ID, nil); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	drainErrCh := make(chan error, 1)
+	go func() {
+		drainErrCh <- serv.Drain(ctx)
+	}()
+
+	for !serv.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	serv.Update(1.0)
+
+	if err := <-drainErrCh; err != context.Canceled {
+		t.Fatalf("expected context.Canceled got: %v\n", err)
+	}
+
+	expected := []ServerEventType{EventClientConnected, EventClientKicked, EventServerDrained}
+	if len(events) != len(expected) {
+		t.Fatalf("expected events %v got %v\n", expected, events)
+	}
+
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("expected events %v got %v\n", expected, events)
+		}
+	}
+}
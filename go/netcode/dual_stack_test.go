@@ -0,0 +1,78 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAddressEqualMapped(t *testing.T) {
+	ipv4 := &net.UDPAddr{IP: net.ParseIP("127.0.0.1").To4(), Port: 40000}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 40000}
+	if !addressEqual(ipv4, mapped) {
+		t.Fatalf("expected IPv4-mapped address to equal its IPv4 form\n")
+	}
+
+	if addressEqual(ipv4, &net.UDPAddr{IP: mapped.IP, Port: 40001}) {
+		t.Fatalf("expected addresses with different ports to differ\n")
+	}
+}
+
+func TestServerDualStack(t *testing.T) {
+	addrs := []net.UDPAddr{
+		{IP: net.ParseIP("::1"), Port: 40008},
+		{IP: net.ParseIP("127.0.0.1"), Port: 40008},
+	}
+
+	serv := NewServer(&addrs[0], TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.AddListenAddress(&addrs[1])
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	clients := make([]*Client, len(addrs))
+	for i := range addrs {
+		connectToken := NewConnectToken()
+		if err := connectToken.Generate(TEST_CLIENT_ID+uint64(i), addrs[i:i+1], VERSION_INFO, TEST_PROTOCOL_ID, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_SEQUENCE_START, make([]byte, USER_DATA_BYTES), TEST_PRIVATE_KEY); err != nil {
+			t.Fatalf("error generating connect token: %s\n", err)
+		}
+
+		clients[i] = NewClient(connectToken)
+		if err := clients[i].Connect(); err != nil {
+			t.Fatalf("error connecting: %s\n", err)
+		}
+		defer clients[i].Close()
+	}
+
+	payload := []byte("dual stack")
+	received := make([]bool, len(clients))
+	clientTime := float64(0)
+	for i := 0; i < 300 && !(received[0] && received[1]); i += 1 {
+		serv.Update(serv.serverTime + 0.01)
+		if serv.HasClients() == len(clients) {
+			serv.SendPayloads(payload, serv.serverTime)
+		}
+
+		for j, client := range clients {
+			client.Update(clientTime)
+			if client.GetState() == StateConnected {
+				if data, _ := client.RecvData(); data != nil {
+					received[j] = true
+				}
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+	}
+
+	for i, client := range clients {
+		if client.GetState() != StateConnected || !received[i] {
+			t.Fatalf("expected client connecting to %s to connect and receive payloads got: %s\n", addrs[i].String(), clientStateMap[client.GetState()])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
@@ -12,7 +13,9 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -21,20 +24,24 @@ var serverAddr string
 var numServers int
 var startingPort int
 var maxClients int
+var banListPath string
 
 //var runProfiler bool
 
 var clientId uint64
 var serverAddrs []net.UDPAddr
+var servers []*netcode.Server
 
 var httpServer *http.Server
 var closeCh chan struct{}
+var accessList *netcode.AccessList
 
 const (
 	PROTOCOL_ID          = 0x1122334455667788
 	CONNECT_TOKEN_EXPIRY = 30
 	TIMEOUT_SECONDS      = 1
 	MAX_PACKET_BYTES     = 1220
+	DRAIN_TIMEOUT        = 30 * time.Second
 )
 
 // obviously you'd generate this outside of both web server and game server and store it in something
@@ -49,6 +56,7 @@ func init() {
 	flag.IntVar(&numServers, "numservers", 3, "number of servers to start on successive ports")
 	flag.IntVar(&startingPort, "port", 40000, "starting port number, increments by 1 for number of servers")
 	flag.IntVar(&maxClients, "maxclients", 256, "number of clients per server")
+	flag.StringVar(&banListPath, "bans", "", "path to a JSON ban list, reloaded on SIGHUP")
 	//flag.BoolVar(&runProfiler, "prof", false, "should we profile")
 }
 
@@ -72,21 +80,33 @@ func main() {
 		}
 	*/
 
+	// all servers share the same ban list
+	accessList = netcode.NewAccessList()
+	if banListPath != "" {
+		if err := accessList.Load(banListPath); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("error loading ban list: %s\n", err)
+		}
+		go reloadBansOnHangup()
+	}
+
 	// start our netcode servers
+	servers = make([]*netcode.Server, numServers)
 	for i := 0; i < numServers; i += 1 {
-		go serveLoop(closeCh, ctrlCloseCh, i)
+		servers[i] = netcode.NewServer(&serverAddrs[i], serverKey, PROTOCOL_ID, maxClients)
+		servers[i].SetAccessList(accessList)
+		go serveLoop(closeCh, ctrlCloseCh, servers[i])
 	}
 
 	// start our web server for generating and handing out connect tokens.
 	http.HandleFunc("/token", serveToken)
 	http.HandleFunc("/shutdown", serveShutdown)
+	http.HandleFunc("/drain", serveDrain)
 
 	httpServer = &http.Server{Addr: webServerAddr}
 	httpServer.ListenAndServe()
 }
 
-func serveLoop(closeCh chan struct{}, ctrlCloseCh chan os.Signal, index int) {
-	serv := netcode.NewServer(&serverAddrs[index], serverKey, PROTOCOL_ID, maxClients)
+func serveLoop(closeCh chan struct{}, ctrlCloseCh chan os.Signal, serv *netcode.Server) {
 	if err := serv.Init(); err != nil {
 		log.Fatalf("error initializing server: %s\n", err)
 	}
@@ -116,7 +136,12 @@ func serveLoop(closeCh chan struct{}, ctrlCloseCh chan os.Signal, index int) {
 		default:
 		}
 
-		serv.Update(serverTime)
+		// Update errors once the server has been drained
+		if err := serv.Update(serverTime); err != nil {
+			log.Printf("server stopped: %s\n", err)
+			return
+		}
+
 		for i := 0; i < serv.MaxClients(); i += 1 {
 			for {
 				responsePayload, _ := serv.RecvPayload(i)
@@ -139,6 +164,20 @@ func serveLoop(closeCh chan struct{}, ctrlCloseCh chan os.Signal, index int) {
 	}
 }
 
+// reloads the ban list from disk whenever the process receives SIGHUP, newly banned
+// clients are kicked on each server's next Update.
+func reloadBansOnHangup() {
+	hangupCh := make(chan os.Signal, 1)
+	signal.Notify(hangupCh, syscall.SIGHUP)
+	for range hangupCh {
+		if err := accessList.Load(banListPath); err != nil {
+			log.Printf("error reloading ban list: %s\n", err)
+			continue
+		}
+		log.Printf("reloaded ban list from %s\n", banListPath)
+	}
+}
+
 func shutdown(serv *netcode.Server) {
 	log.Printf("shutting down server")
 	serv.Stop()
@@ -159,6 +198,41 @@ func serveShutdown(w http.ResponseWriter, r *http.Request) {
 	close(closeCh)
 }
 
+// drains every server, new clients are denied while existing clients are given until the
+// timeout, e.g. /drain?timeout=10s, to leave before being kicked.
+func serveDrain(w http.ResponseWriter, r *http.Request) {
+	timeout := DRAIN_TIMEOUT
+	if value := r.URL.Query().Get("timeout"); value != "" {
+		var err error
+		if timeout, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "invalid timeout", http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	results := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, serv := range servers {
+		wg.Add(1)
+		go func(i int, serv *netcode.Server) {
+			defer wg.Done()
+			results[i] = serv.Drain(ctx)
+		}(i, serv)
+	}
+	wg.Wait()
+
+	for i, err := range results {
+		if err != nil {
+			fmt.Fprintf(w, "server %s: drained with error: %s\n", serverAddrs[i].String(), err)
+			continue
+		}
+		fmt.Fprintf(w, "server %s: drained\n", serverAddrs[i].String())
+	}
+}
+
 func serveToken(w http.ResponseWriter, r *http.Request) {
 	clientId := incClientId() // safely increment the clientId
 
@@ -172,7 +246,7 @@ func serveToken(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(webToken)
 }
 
-func connectTokenGenerator(clientId uint64, serverAddrs []net.UDPAddr, versionInfo string, protocolId uint64, tokenExpiry uint64, timeoutSeconds uint32, sequence uint64) ([]byte, error) {
+func connectTokenGenerator(clientId uint64, serverAddrs []net.UDPAddr, versionInfo string, protocolId uint64, tokenExpiry uint64, timeoutSeconds int32, sequence uint64) ([]byte, error) {
 	userData, err := netcode.RandomBytes(netcode.USER_DATA_BYTES)
 	if err != nil {
 		return nil, err
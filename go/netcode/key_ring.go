@@ -0,0 +1,168 @@
+package netcode
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A private key shared with the connect token issuer. Keys are only tried for connect token
+// decryption between their activation and retirement times.
+type PrivateKey struct {
+	Id       string    // identifies the key in stats and logs
+	Key      []byte    // KEY_BYTES shared secret
+	Activate time.Time // zero time means active immediately
+	Retire   time.Time // zero time means never retires
+}
+
+// Number of connect tokens decrypted with a key in the ring.
+type KeyStats struct {
+	Id             string
+	TokensAccepted uint64
+}
+
+type keyRingEntry struct {
+	PrivateKey
+	tokensAccepted uint64
+}
+
+func (e *keyRingEntry) active(now time.Time) bool {
+	return (e.Activate.IsZero() || !now.Before(e.Activate)) && (e.Retire.IsZero() || now.Before(e.Retire))
+}
+
+// A set of current and previous private keys so the key shared with the token issuer can be
+// rotated without failing tokens already handed out. Safe to modify from any goroutine.
+type KeyRing struct {
+	mutex   sync.RWMutex
+	entries []*keyRingEntry
+}
+
+func NewKeyRing(keys ...PrivateKey) (*KeyRing, error) {
+	r := &KeyRing{}
+	for _, key := range keys {
+		if err := r.Add(key); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Adds the key to the ring, replacing any existing key with the same id.
+func (r *KeyRing) Add(key PrivateKey) error {
+	if len(key.Key) != KEY_BYTES {
+		return errors.New("invalid private key size")
+	}
+
+	if !key.Retire.IsZero() && !key.Retire.After(key.Activate) {
+		return errors.New("private key " + key.Id + " retires before it activates")
+	}
+
+	entry := &keyRingEntry{PrivateKey: key}
+	entry.Key = make([]byte, KEY_BYTES)
+	copy(entry.Key, key.Key)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, existing := range r.entries {
+		if existing.Id == key.Id {
+			r.entries[i] = entry
+			r.sortEntries()
+			return nil
+		}
+	}
+	r.entries = append(r.entries, entry)
+	r.sortEntries()
+	return nil
+}
+
+// Removes the key with the id from the ring.
+func (r *KeyRing) Remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i, entry := range r.entries {
+		if entry.Id == id {
+			r.entries = append(r.entries[:i], r.entries[i+1:]...)
+			return
+		}
+	}
+}
+
+// newest activation first, as new tokens will most likely be issued with the newest key.
+func (r *KeyRing) sortEntries() {
+	sort.SliceStable(r.entries, func(i, j int) bool {
+		return r.entries[i].Activate.After(r.entries[j].Activate)
+	})
+}
+
+// returns the keys which may be used to decrypt tokens at the time.
+func (r *KeyRing) activeEntries(now time.Time) []*keyRingEntry {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	active := make([]*keyRingEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		if entry.active(now) {
+			active = append(active, entry)
+		}
+	}
+	return active
+}
+
+// Returns the number of connect tokens decrypted with each key, newest activation first.
+func (r *KeyRing) Stats() []KeyStats {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	stats := make([]KeyStats, len(r.entries))
+	for i, entry := range r.entries {
+		stats[i] = KeyStats{Id: entry.Id, TokensAccepted: atomic.LoadUint64(&entry.tokensAccepted)}
+	}
+	return stats
+}
+
+// Sets the key ring used to decrypt connect tokens in place of the private key passed to
+// NewServer, a nil ring reverts to the private key. Must be called from the same goroutine
+// as Update, keys may be added to or removed from the ring at any time.
+func (s *Server) SetKeyRing(keyRing *KeyRing) {
+	s.keyRing = keyRing
+}
+
+// reads the connection request trying each active key in the ring. Decryption is in place
+// so each attempt works on a fresh copy of the packet.
+func (s *Server) readKeyRingRequest(packetData []byte, size int, timestamp uint64) (Packet, error) {
+	entries := s.keyRing.activeEntries(s.clock.Now())
+	if len(entries) == 0 {
+		return nil, errors.New("ignored connection request packet. no active private keys")
+	}
+
+	var err error
+	buffer := make([]byte, len(packetData))
+	for _, entry := range entries {
+		copy(buffer, packetData)
+		packet := &RequestPacket{}
+		if err = packet.Read(buffer, size, s.protocolId, timestamp, nil, entry.Key, s.allowedPackets, nil); err == nil {
+			atomic.AddUint64(&entry.tokensAccepted, 1)
+			if logEnabled(s.logger, LogLevelDebug) {
+				s.logger.Log(LogLevelDebug, "server decrypted connect token", LogField{"key", entry.Id})
+			}
+			return packet, nil
+		}
+
+		if _, ok := err.(*decryptError); !ok {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+func writePrometheusKeyStats(w io.Writer, stats []KeyStats) {
+	if len(stats) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP netcode_server_tokens_accepted_total Connect tokens decrypted with each private key.\n# TYPE netcode_server_tokens_accepted_total counter\n")
+	for _, key := range stats {
+		fmt.Fprintf(w, "netcode_server_tokens_accepted_total{key=%q} %d\n", key.Id, key.TokensAccepted)
+	}
+}
@@ -0,0 +1,104 @@
+package netcode
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyRing(t *testing.T) {
+	oldKey, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	newKey, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	retiredKey, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	now := time.Now()
+	keyRing, err := NewKeyRing(
+		PrivateKey{Id: "old", Key: oldKey, Retire: now.Add(time.Hour)},
+		PrivateKey{Id: "new", Key: newKey, Activate: now.Add(-time.Minute)},
+		PrivateKey{Id: "retired", Key: retiredKey, Activate: now.Add(-time.Hour), Retire: now.Add(-time.Minute)},
+	)
+	if err != nil {
+		t.Fatalf("error creating key ring: %s\n", err)
+	}
+
+	if err := keyRing.Add(PrivateKey{Id: "bad", Key: []byte("short")}); err == nil {
+		t.Fatalf("expected error adding key of wrong size\n")
+	}
+
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, nil, TEST_PROTOCOL_ID, 4)
+	serv.SetLogger(nil)
+	serv.SetKeyRing(keyRing)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	from := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 9}
+	for _, key := range [][]byte{oldKey, newKey, newKey, retiredKey} {
+		serv.OnPacketData(testRequestPacketData(key, t), from)
+	}
+
+	stats := keyRing.Stats()
+	expected := []KeyStats{{Id: "new", TokensAccepted: 2}, {Id: "retired", TokensAccepted: 0}, {Id: "old", TokensAccepted: 1}}
+	if len(stats) != len(expected) {
+		t.Fatalf("expected key stats %v got %v\n", expected, stats)
+	}
+
+	for i := range expected {
+		if stats[i] != expected[i] {
+			t.Fatalf("expected key stats %v got %v\n", expected, stats)
+		}
+	}
+
+	if serv.Stats().DecryptFailures != 1 {
+		t.Fatalf("expected token encrypted with retired key to fail decryption\n")
+	}
+
+	recorder := httptest.NewRecorder()
+	serv.StatsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(recorder.Body.String(), `netcode_server_tokens_accepted_total{key="new"} 2`) {
+		t.Fatalf("expected per key metric in output:\n%s\n", recorder.Body.String())
+	}
+
+	keyRing.Remove("new")
+	serv.OnPacketData(testRequestPacketData(newKey, t), from)
+	if serv.Stats().DecryptFailures != 2 {
+		t.Fatalf("expected token encrypted with removed key to fail decryption\n")
+	}
+}
+
+// returns a serialized connection request for a new connect token encrypted with the key.
+func testRequestPacketData(privateKey []byte, t *testing.T) []byte {
+	connectToken := testGenerateConnectToken([]net.UDPAddr{{IP: net.ParseIP("::1"), Port: 0}}, privateKey, t)
+	packet := &RequestPacket{}
+	packet.VersionInfo = connectToken.VersionInfo
+	packet.ProtocolId = connectToken.ProtocolId
+	packet.ConnectTokenExpireTimestamp = connectToken.ExpireTimestamp
+	packet.ConnectTokenSequence = connectToken.Sequence
+	packet.ConnectTokenData = connectToken.PrivateData.Buffer()
+
+	buffer := make([]byte, MAX_PACKET_BYTES)
+	bytesWritten, err := packet.Write(buffer, TEST_PROTOCOL_ID, 0, nil)
+	if err != nil {
+		t.Fatalf("error writing request packet: %s\n", err)
+	}
+	return buffer[:bytesWritten]
+}
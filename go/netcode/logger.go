@@ -0,0 +1,117 @@
+package netcode
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+)
+
+// Log levels, these match the netcode_log_level values of the reference implementation.
+type LogLevel int
+
+const (
+	LogLevelNone LogLevel = iota
+	LogLevelError
+	LogLevelInfo
+	LogLevelDebug
+)
+
+// reference map of log level -> string values
+var logLevelMap = map[LogLevel]string{
+	LogLevelNone:  "none",
+	LogLevelError: "error",
+	LogLevelInfo:  "info",
+	LogLevelDebug: "debug",
+}
+
+func (l LogLevel) String() string {
+	return logLevelMap[l]
+}
+
+// A structured key/value pair attached to a log message.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is implemented by anything that wants to receive netcode log messages. The
+// Server, Client and NetcodeConn all accept a Logger via SetLogger.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// Optionally implemented by a Logger to allow callers to skip building fields for
+// messages that will be discarded.
+type levelEnabler interface {
+	Enabled(level LogLevel) bool
+}
+
+// The default Logger, writes messages at or below the level to the standard log package.
+type stdLogger struct {
+	level LogLevel
+}
+
+// Returns a Logger that writes messages at or below level to the standard log package
+// in the form "[level] message key=value key=value".
+func NewLogger(level LogLevel) Logger {
+	return &stdLogger{level: level}
+}
+
+func (l *stdLogger) Enabled(level LogLevel) bool {
+	return level != LogLevelNone && level <= l.level
+}
+
+func (l *stdLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	buf.WriteString(level.String())
+	buf.WriteString("] ")
+	buf.WriteString(msg)
+	for _, field := range fields {
+		fmt.Fprintf(&buf, " %s=%v", field.Key, field.Value)
+	}
+	log.Print(buf.String())
+}
+
+// Returns true if the logger would output a message at this level. Loggers that do
+// not implement Enabled are always sent the message.
+func logEnabled(logger Logger, level LogLevel) bool {
+	if enabler, ok := logger.(levelEnabler); ok {
+		return enabler.Enabled(level)
+	}
+	return true
+}
+
+// ensures a nil logger never needs to be checked for.
+func loggerOrNone(logger Logger) Logger {
+	if logger == nil {
+		return NewLogger(LogLevelNone)
+	}
+	return logger
+}
+
+// helpers for the fields commonly attached to messages
+func fieldClientId(clientId uint64) LogField {
+	return LogField{Key: "clientId", Value: clientId}
+}
+
+func fieldClientIndex(clientIndex int) LogField {
+	return LogField{Key: "clientIndex", Value: clientIndex}
+}
+
+func fieldAddress(addr *net.UDPAddr) LogField {
+	return LogField{Key: "address", Value: addr}
+}
+
+func fieldPacketType(packetType PacketType) LogField {
+	return LogField{Key: "packetType", Value: packetTypeMap[packetType]}
+}
+
+func fieldError(err error) LogField {
+	return LogField{Key: "error", Value: err}
+}
@@ -0,0 +1,110 @@
+package netcode
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testLogEntry struct {
+	level  LogLevel
+	msg    string
+	fields []LogField
+}
+
+type testLogger struct {
+	entries []testLogEntry
+}
+
+func (l *testLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	l.entries = append(l.entries, testLogEntry{level: level, msg: msg, fields: fields})
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logger := NewLogger(LogLevelInfo)
+	addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}
+	logger.Log(LogLevelDebug, "debug message", fieldClientId(1))
+	if buf.Len() != 0 {
+		t.Fatalf("debug message should have been filtered: %s\n", buf.String())
+	}
+
+	logger.Log(LogLevelInfo, "info message", fieldClientId(1), fieldAddress(addr), fieldPacketType(ConnectionKeepAlive))
+	out := buf.String()
+	if !strings.Contains(out, "[info] info message clientId=1 address=[::1]:40000 packetType=CONNECTION_KEEPALIVE") {
+		t.Fatalf("unexpected log output: %s\n", out)
+	}
+
+	buf.Reset()
+	logger = NewLogger(LogLevelNone)
+	logger.Log(LogLevelError, "error message")
+	if buf.Len() != 0 {
+		t.Fatalf("no messages should be written at LogLevelNone: %s\n", buf.String())
+	}
+}
+
+func TestLogEnabled(t *testing.T) {
+	if logEnabled(NewLogger(LogLevelInfo), LogLevelDebug) {
+		t.Fatalf("debug should be disabled for an info logger\n")
+	}
+
+	if !logEnabled(NewLogger(LogLevelDebug), LogLevelDebug) {
+		t.Fatalf("debug should be enabled for a debug logger\n")
+	}
+
+	// loggers without Enabled are sent every message
+	if !logEnabled(&testLogger{}, LogLevelDebug) {
+		t.Fatalf("debug should be enabled for a logger without Enabled\n")
+	}
+
+	logger := NewLogger(LogLevelInfo)
+	allocs := testing.AllocsPerRun(100, func() {
+		if logEnabled(logger, LogLevelDebug) {
+			logger.Log(LogLevelDebug, "server received connection request", fieldClientId(TEST_CLIENT_ID))
+		}
+	})
+
+	if allocs != 0 {
+		t.Fatalf("expected disabled debug logs not to allocate got %v allocs\n", allocs)
+	}
+}
+
+func TestServerSetLogger(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 2)
+	logger := &testLogger{}
+	serv.SetLogger(logger)
+
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	serv.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {})
+	if err := serv.ConnectLoopbackClient(0, TEST_CLIENT_ID, nil); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	if serv.serverConns[0].logger != logger || serv.clientManager.instances[1].logger != logger {
+		t.Fatalf("logger was not set on the connection and client slots\n")
+	}
+
+	if len(logger.entries) != 1 || logger.entries[0].level != LogLevelInfo {
+		t.Fatalf("expected 1 info log entry got: %#v\n", logger.entries)
+	}
+
+	entry := logger.entries[0]
+	if entry.fields[0].Key != "clientId" || entry.fields[0].Value != uint64(TEST_CLIENT_ID) {
+		t.Fatalf("expected clientId field got: %#v\n", entry.fields)
+	}
+}
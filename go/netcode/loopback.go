@@ -0,0 +1,139 @@
+package netcode
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Called whenever a loopback client or server sends a payload. The clientIndex is the slot
+// of the loopback client, the receiving side should pass the payload and sequence to its
+// ProcessLoopbackPacket method.
+type LoopbackSendHandler func(clientIndex int, payloadData []byte, sequence uint64)
+
+// Sets the handler used to deliver payloads to loopback clients.
+func (s *Server) SetLoopbackHandler(loopbackHandlerFn LoopbackSendHandler) {
+	s.clientManager.setLoopbackHandler(loopbackHandlerFn)
+}
+
+// Connects an in-process client in the provided slot. Loopback clients skip the handshake,
+// encryption and sockets entirely, payloads are exchanged via the LoopbackSendHandler.
+func (s *Server) ConnectLoopbackClient(clientIndex int, clientId uint64, userData []byte) error {
+	if !s.running {
+		return errors.New("server is not running")
+	}
+
+	if clientIndex < 0 || clientIndex >= s.maxClients {
+		return errors.New("invalid client index " + strconv.Itoa(clientIndex))
+	}
+
+	if s.clientManager.loopbackHandlerFn == nil {
+		return errors.New("loopback handler must be set before connecting loopback clients")
+	}
+
+	if s.clientManager.FindClientIndexById(clientId) != -1 {
+		return errors.New("a client with this id is already connected")
+	}
+
+	client := s.clientManager.ConnectLoopbackClient(clientIndex, clientId, userData, s.serverTime)
+	if client == nil {
+		return errors.New("client slot " + strconv.Itoa(clientIndex) + " is already in use")
+	}
+	client.protocolId = s.protocolId
+	s.logger.Log(LogLevelInfo, "server connected loopback client", fieldClientId(clientId), fieldClientIndex(clientIndex))
+	s.clientManager.emitEvent(EventClientConnected, client)
+	return nil
+}
+
+// Disconnects the loopback client in the provided slot.
+func (s *Server) DisconnectLoopbackClient(clientIndex int) error {
+	if !s.IsLoopbackClient(clientIndex) {
+		return errors.New("client slot " + strconv.Itoa(clientIndex) + " is not a loopback client")
+	}
+
+	s.logger.Log(LogLevelInfo, "server disconnected loopback client", fieldClientIndex(clientIndex))
+	s.clientManager.disconnectClient(s.clientManager.instances[clientIndex], false, s.serverTime, EventClientDisconnected)
+	return nil
+}
+
+// Returns true if the slot is occupied by a connected loopback client.
+func (s *Server) IsLoopbackClient(clientIndex int) bool {
+	if !s.running || clientIndex < 0 || clientIndex >= s.maxClients {
+		return false
+	}
+	client := s.clientManager.instances[clientIndex]
+	return client.connected && client.loopback
+}
+
+// Queues a payload sent by the loopback client in the provided slot so it is returned
+// by RecvPayload. Must be called from the same goroutine as Update.
+func (s *Server) ProcessLoopbackPacket(clientIndex int, payloadData []byte, sequence uint64) error {
+	if !s.IsLoopbackClient(clientIndex) {
+		return errors.New("client slot " + strconv.Itoa(clientIndex) + " is not a loopback client")
+	}
+
+	client := s.clientManager.instances[clientIndex]
+	client.lastRecvTime = s.serverTime
+	if client.packetQueue.Push(newLoopbackPayloadPacket(payloadData, sequence)) == 0 {
+		s.stats.addQueueOverflow()
+		client.stats.addQueueOverflow()
+	}
+	return nil
+}
+
+// Sets the handler used to deliver payloads to the server when connected via loopback.
+func (c *Client) SetLoopbackHandler(loopbackHandlerFn LoopbackSendHandler) {
+	c.loopbackHandlerFn = loopbackHandlerFn
+}
+
+// Puts the client directly into the connected state as the loopback client in clientIndex,
+// no sockets are opened and no connect token is required.
+func (c *Client) ConnectLoopback(clientIndex, maxClients int) error {
+	if c.GetState() > StateDisconnected {
+		return errors.New("client is already connected or connecting")
+	}
+
+	if c.loopbackHandlerFn == nil {
+		return errors.New("loopback handler must be set before connecting via loopback")
+	}
+
+	c.logger.Log(LogLevelInfo, "client connected to server via loopback", c.fieldId(), fieldClientIndex(clientIndex))
+	c.clientIndex = uint32(clientIndex)
+	c.maxClients = uint32(maxClients)
+	c.loopback = true
+	c.setState(StateConnected)
+	return nil
+}
+
+// Disconnects the loopback client.
+func (c *Client) DisconnectLoopback() error {
+	if !c.loopback {
+		return errors.New("client is not connected via loopback")
+	}
+	c.resetConnectionData(StateDisconnected)
+	return nil
+}
+
+// Returns true if the client is connected via loopback.
+func (c *Client) IsLoopback() bool {
+	return c.loopback
+}
+
+// Queues a payload sent by the server so it is returned by RecvData.
+func (c *Client) ProcessLoopbackPacket(payloadData []byte, sequence uint64) error {
+	if !c.loopback {
+		return errors.New("client is not connected via loopback")
+	}
+	if c.packetQueue.Push(newLoopbackPayloadPacket(payloadData, sequence)) == 0 {
+		c.stats.addQueueOverflow()
+	}
+	return nil
+}
+
+// copies the payload into a pooled packet so the sender is free to re-use its buffer.
+func newLoopbackPayloadPacket(payloadData []byte, sequence uint64) *PayloadPacket {
+	packet := payloadPacketPool.Get().(*PayloadPacket)
+	packet.PayloadData = append(packet.PayloadData[:0], payloadData...)
+	packet.PayloadBytes = uint32(len(payloadData))
+	packet.sequence = sequence
+	return packet
+}
@@ -0,0 +1,93 @@
+package netcode
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestLoopbackClient(t *testing.T) {
+	maxClients := 4
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, maxClients)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	client := NewClient(nil)
+	serv.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {
+		client.ProcessLoopbackPacket(payloadData, sequence)
+	})
+	client.SetLoopbackHandler(func(clientIndex int, payloadData []byte, sequence uint64) {
+		serv.ProcessLoopbackPacket(clientIndex, payloadData, sequence)
+	})
+
+	clientIndex := 1
+	if err := serv.ConnectLoopbackClient(clientIndex, TEST_CLIENT_ID, nil); err != nil {
+		t.Fatalf("error connecting loopback client: %s\n", err)
+	}
+
+	if err := serv.ConnectLoopbackClient(clientIndex, TEST_CLIENT_ID+1, nil); err == nil {
+		t.Fatalf("expected error connecting loopback client to used slot\n")
+	}
+
+	if err := client.ConnectLoopback(clientIndex, maxClients); err != nil {
+		t.Fatalf("error connecting client via loopback: %s\n", err)
+	}
+
+	if !serv.IsLoopbackClient(clientIndex) || !client.IsLoopback() {
+		t.Fatalf("client should be connected via loopback\n")
+	}
+
+	if serv.HasClients() != 1 {
+		t.Fatalf("expected 1 connected client got %d\n", serv.HasClients())
+	}
+
+	payload := []byte("loopback payload")
+	serverTime := float64(0)
+	for i := 0; i < 3; i += 1 {
+		if err := client.SendData(payload); err != nil {
+			t.Fatalf("error sending loopback data: %s\n", err)
+		}
+
+		data, sequence := serv.RecvPayload(clientIndex)
+		if !bytes.Equal(data, payload) || sequence != uint64(i) {
+			t.Fatalf("server recv'd wrong loopback payload %v seq: %d\n", data, sequence)
+		}
+
+		if err := serv.SendPayloadToClient(TEST_CLIENT_ID, payload, serverTime); err != nil {
+			t.Fatalf("error sending payload to loopback client: %s\n", err)
+		}
+
+		data, sequence = client.RecvData()
+		if !bytes.Equal(data, payload) || sequence != uint64(i) {
+			t.Fatalf("client recv'd wrong loopback payload %v seq: %d\n", data, sequence)
+		}
+
+		// loopback clients never time out
+		serverTime += float64(TIMEOUT_SECONDS)
+		serv.Update(serverTime)
+		client.Update(serverTime)
+	}
+
+	if serv.HasClients() != 1 || client.GetState() != StateConnected {
+		t.Fatalf("loopback client should still be connected\n")
+	}
+
+	if err := serv.DisconnectLoopbackClient(clientIndex); err != nil {
+		t.Fatalf("error disconnecting loopback client: %s\n", err)
+	}
+
+	if err := client.DisconnectLoopback(); err != nil {
+		t.Fatalf("error disconnecting client loopback: %s\n", err)
+	}
+
+	if serv.HasClients() != 0 || client.GetState() != StateDisconnected || client.IsLoopback() {
+		t.Fatalf("loopback client should be disconnected\n")
+	}
+}
@@ -1,14 +1,18 @@
 package netcode
 
 import (
+	"context"
 	"errors"
-	"log"
 	"net"
+
+	"golang.org/x/net/ipv4"
 )
 
 type NetcodeData struct {
-	data []byte
-	from *net.UDPAddr
+	data   []byte
+	from   *net.UDPAddr
+	conn   *NetcodeConn // socket the data was received on
+	buffer []byte       // MAX_PACKET_BYTES backing data when taken from the pool
 }
 
 const (
@@ -19,15 +23,28 @@ const (
 type NetcodeRecvHandler func(data *NetcodeData)
 
 type NetcodeConn struct {
-	conn     *net.UDPConn
-	closeCh  chan struct{}
-	isClosed bool
-
-	recvSize int
-	sendSize int
-	maxBytes int
+	conn          *net.UDPConn // nil when a Transport was set with SetTransport
+	transport     Transport    // the socket packets are read from and written to
+	userTransport Transport
+	remoteAddr    *net.UDPAddr // address passed to Dial
+	closeCh       chan struct{}
+	isClosed      bool
+
+	recvSize  int
+	sendSize  int
+	maxBytes  int
+	reusePort bool // bind with SO_REUSEPORT so several sockets can share the address
+
+	batchSize  int
+	batch      batchConn // nil unless batching is enabled
+	readMsgs   []ipv4.Message
+	readData   []*NetcodeData // pooled buffers backing readMsgs
+	writeMsgs  []ipv4.Message // queued writes, owned by the goroutine writing
+	writeCount int
 
 	recvHandlerFn NetcodeRecvHandler
+	logger        Logger
+	rateLimiter   *rateLimiter
 }
 
 func NewNetcodeConn() *NetcodeConn {
@@ -38,25 +55,49 @@ func NewNetcodeConn() *NetcodeConn {
 	c.maxBytes = MAX_PACKET_BYTES
 	c.recvSize = SOCKET_RCVBUF_SIZE
 	c.sendSize = SOCKET_SNDBUF_SIZE
+	c.logger = NewLogger(LogLevelInfo)
 	return c
 }
 
+// Sets the logger used for socket errors, a nil logger disables logging.
+func (c *NetcodeConn) SetLogger(logger Logger) {
+	c.logger = loggerOrNone(logger)
+}
+
+// sets the limiter checked before unauthenticated packets are dispatched, must be
+// called before Listen.
+func (c *NetcodeConn) setRateLimiter(limiter *rateLimiter) {
+	c.rateLimiter = limiter
+}
+
 func (c *NetcodeConn) SetRecvHandler(recvHandlerFn NetcodeRecvHandler) {
 	c.recvHandlerFn = recvHandlerFn
 }
 
+// Sets the transport used instead of a UDP socket, Listen and Dial start reading from it
+// rather than opening a socket. The NetcodeConn owns the transport and closes it on Close.
+// Batching and socket buffer sizes only apply to UDP sockets. Must be called before Listen or Dial.
+func (c *NetcodeConn) SetTransport(transport Transport) {
+	c.userTransport = transport
+}
+
+// Writes to the address passed to Dial.
 func (c *NetcodeConn) Write(b []byte) (int, error) {
 	if c.isClosed {
 		return -1, errors.New("unable to write, socket has been closed")
 	}
-	return c.conn.Write(b)
+
+	if c.conn != nil {
+		return c.conn.Write(b)
+	}
+	return c.transport.WriteTo(b, c.remoteAddr)
 }
 
 func (c *NetcodeConn) WriteTo(b []byte, to *net.UDPAddr) (int, error) {
 	if c.isClosed {
 		return -1, errors.New("unable to write, socket has been closed")
 	}
-	return c.conn.WriteTo(b, to)
+	return c.transport.WriteTo(b, to)
 }
 
 func (c *NetcodeConn) Close() error {
@@ -64,7 +105,10 @@ func (c *NetcodeConn) Close() error {
 		close(c.closeCh)
 	}
 	c.isClosed = true
-	return c.conn.Close()
+	if c.transport == nil {
+		return nil
+	}
+	return c.transport.Close()
 }
 
 func (c *NetcodeConn) SetReadBuffer(bytes int) {
@@ -77,12 +121,15 @@ func (c *NetcodeConn) SetWriteBuffer(bytes int) {
 
 // LocalAddr returns the local network address.
 func (c *NetcodeConn) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
+	return c.transport.LocalAddr()
 }
 
 // RemoteAddr returns the remote network address.
 func (c *NetcodeConn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	if c.conn != nil {
+		return c.conn.RemoteAddr()
+	}
+	return c.remoteAddr
 }
 
 func (c *NetcodeConn) Dial(address *net.UDPAddr) error {
@@ -93,33 +140,63 @@ func (c *NetcodeConn) Dial(address *net.UDPAddr) error {
 	}
 
 	c.closeCh = make(chan struct{})
+	c.remoteAddr = address
+	if c.userTransport != nil {
+		c.transport = c.userTransport
+		return c.create()
+	}
+
 	c.conn, err = net.DialUDP(address.Network(), nil, address)
 	if err != nil {
 		return err
 	}
+	c.transport = c.conn
 	return c.create()
 }
 
 func (c *NetcodeConn) Listen(address *net.UDPAddr) error {
+	return c.listen(address.Network(), address)
+}
+
+func (c *NetcodeConn) listen(network string, address *net.UDPAddr) error {
 	var err error
 
 	if c.recvHandlerFn == nil {
 		return errors.New("packet handler must be set before calling listen")
 	}
 
-	c.conn, err = net.ListenUDP(address.Network(), address)
-	if err != nil {
-		return err
+	if c.userTransport != nil {
+		c.transport = c.userTransport
+		return c.create()
 	}
 
+	if c.reusePort {
+		var conn net.PacketConn
+		listenConfig := &net.ListenConfig{Control: reusePortControl}
+		conn, err = listenConfig.ListenPacket(context.Background(), network, address.String())
+		if err != nil {
+			return err
+		}
+		c.conn = conn.(*net.UDPConn)
+	} else {
+		c.conn, err = net.ListenUDP(network, address)
+		if err != nil {
+			return err
+		}
+	}
+	c.transport = c.conn
+
 	c.create()
 	return err
 }
 
 func (c *NetcodeConn) create() error {
 	c.isClosed = false
-	c.conn.SetReadBuffer(c.recvSize)
-	c.conn.SetWriteBuffer(c.sendSize)
+	if c.conn != nil {
+		c.conn.SetReadBuffer(c.recvSize)
+		c.conn.SetWriteBuffer(c.sendSize)
+	}
+	c.createBatch()
 	go c.readLoop()
 	return nil
 }
@@ -127,7 +204,14 @@ func (c *NetcodeConn) create() error {
 func (c *NetcodeConn) receiver(ch chan *NetcodeData) {
 	for {
 
-		if err := c.read(); err == nil {
+		var err error
+		if c.batch != nil {
+			err = c.readBatch()
+		} else {
+			err = c.read()
+		}
+
+		if err == nil {
 			select {
 			case <-c.closeCh:
 				return
@@ -135,10 +219,13 @@ func (c *NetcodeConn) receiver(ch chan *NetcodeData) {
 				continue
 			}
 		} else {
-			if c.isClosed {
+			// isClosed is owned by the goroutine calling Close, check the channel instead
+			select {
+			case <-c.closeCh:
 				return
+			default:
 			}
-			log.Printf("error reading data from socket: %s\n", err)
+			c.logger.Log(LogLevelError, "error reading data from socket", fieldError(err))
 		}
 
 	}
@@ -148,32 +235,57 @@ func (c *NetcodeConn) receiver(ch chan *NetcodeData) {
 // buffer > 0 and < maxBytes and is of a valid packet type before
 // we bother to attempt to actually dispatch it to the recvHandlerFn.
 func (c *NetcodeConn) read() error {
-	var n int
-	var from *net.UDPAddr
-	var err error
-	netData := &NetcodeData{}
-	netData.data = make([]byte, c.maxBytes)
+	netData := acquireNetcodeData()
+	if c.conn != nil {
+		n, from, err := c.conn.ReadFromUDP(netData.data)
+		if err != nil {
+			netData.release()
+			return err
+		}
+		return c.dispatch(netData, n, from)
+	}
 
-	n, from, err = c.conn.ReadFromUDP(netData.data)
+	n, addr, err := c.transport.ReadFrom(netData.data)
 	if err != nil {
+		netData.release()
 		return err
 	}
 
+	from, ok := addr.(*net.UDPAddr)
+	if !ok {
+		netData.release()
+		return errors.New("transport returned a non UDP address")
+	}
+	return c.dispatch(netData, n, from)
+}
+
+// validates the n bytes read into netData and hands them to the recvHandlerFn, which then
+// owns netData. Dropped packets are returned to the pool.
+func (c *NetcodeConn) dispatch(netData *NetcodeData, n int, from *net.UDPAddr) error {
 	if n == 0 {
+		netData.release()
 		return errors.New("socket error: 0 byte length recv'd")
 	}
 
 	if n > c.maxBytes {
+		netData.release()
 		return errors.New("packet size was > maxBytes")
 	}
 
 	// check if it's a valid packet
-	if NewPacket(netData.data) == nil {
+	if PacketType(0).Peek(netData.data) >= ConnectionNumPackets {
+		netData.release()
 		return errors.New("data was not a valid netcode.io packet")
 	}
 
+	// drop floods prior to the server decrypting the connect token
+	if c.rateLimiter != nil && !c.rateLimiter.allow(PacketType(0).Peek(netData.data), from) {
+		return nil
+	}
+
 	netData.data = netData.data[:n]
 	netData.from = from
+	netData.conn = c
 	c.recvHandlerFn(netData)
 	return nil
 }
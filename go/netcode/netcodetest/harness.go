@@ -0,0 +1,212 @@
+package netcodetest
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/networkprotocol/netcode.io/go/netcode"
+)
+
+const (
+	PROTOCOL_ID          = 0x1122334455667788
+	CONNECT_TOKEN_EXPIRY = 30
+	TIMEOUT_SECONDS      = 1
+)
+
+// how long Step waits for packets to be handed to their server or client. Packets are handed
+// over in microseconds, this only stops a stuck reader hanging the test.
+const DELIVERY_TIMEOUT = 5 * time.Second
+
+// the time the clock starts at, fixed so tokens and timestamps are the same on every run.
+var START_TIME = time.Unix(1500000000, 0)
+
+type Config struct {
+	MaxClients     int
+	ProtocolId     uint64
+	PrivateKey     []byte
+	TokenExpiry    uint64 // seconds connect tokens made by ConnectToken are valid for
+	TimeoutSeconds int32  // timeout written to connect tokens made by ConnectToken
+	Seed           int64  // seeds the network simulators, each is given its own seed from it
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxClients:     8,
+		ProtocolId:     PROTOCOL_ID,
+		PrivateKey:     []byte{0x60, 0x6a, 0xbe, 0x6e, 0xc9, 0x19, 0x10, 0xea, 0x9a, 0x65, 0x62, 0xf6, 0x6f, 0x2b, 0x30, 0xe4, 0x43, 0x71, 0xd6, 0x2c, 0xd1, 0x99, 0x27, 0x26, 0x6b, 0x3c, 0x60, 0xf4, 0xb7, 0x15, 0xab, 0xa1},
+		TokenExpiry:    CONNECT_TOKEN_EXPIRY,
+		TimeoutSeconds: TIMEOUT_SECONDS,
+		Seed:           1,
+	}
+}
+
+// Runs a Server and any number of Clients in one process over a MemoryNetwork with a
+// ManualClock. Step advances the clock and updates every client then the server, waiting for
+// the packets each sends to be handed to the other before moving on, so handshakes, timeouts
+// and token expiry play out the same way on every run without sockets or sleeping. Every
+// transport is wrapped in a NetworkSimulator on the same clock, set conditions on ServerNetwork
+// or ClientNetworks to add latency or loss, and Step delivers the packets as they become due.
+type Harness struct {
+	Clock          *netcode.ManualClock
+	Network        *netcode.MemoryNetwork
+	Server         *netcode.Server
+	ServerAddr     net.UDPAddr
+	ServerNetwork  *netcode.NetworkSimulator
+	Clients        []*netcode.Client
+	ClientNetworks []*netcode.NetworkSimulator // the simulator of each client in Clients
+
+	config Config
+	time   float64 // seconds since the harness started, passed to Update
+}
+
+// Creates the network and clock and starts the server listening on 10.0.0.1:40000.
+func New(config Config) (*Harness, error) {
+	h := &Harness{config: config}
+	h.Clock = netcode.NewManualClock(START_TIME)
+	h.Network = netcode.NewMemoryNetwork()
+	h.ServerAddr = net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	transport, err := h.Network.Listen(&h.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	h.ServerNetwork = netcode.NewNetworkSimulator(transport, config.Seed)
+	h.ServerNetwork.SetClock(h.Clock)
+
+	h.Server = netcode.NewServer(&h.ServerAddr, config.PrivateKey, config.ProtocolId, config.MaxClients)
+	h.Server.SetTransport(h.ServerNetwork)
+	h.Server.SetClock(h.Clock)
+	if err := h.Server.Init(); err != nil {
+		return nil, err
+	}
+
+	if err := h.Server.Listen(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Returns a connect token for the harness's server created at the clock's current time.
+func (h *Harness) ConnectToken(clientId uint64) (*netcode.ConnectToken, error) {
+	token := netcode.NewConnectToken()
+	userData := make([]byte, netcode.USER_DATA_BYTES)
+	if err := token.GenerateAt(h.Clock.Now(), clientId, []net.UDPAddr{h.ServerAddr}, netcode.VERSION_INFO, h.config.ProtocolId, h.config.TokenExpiry, h.config.TimeoutSeconds, 0, userData, h.config.PrivateKey); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Creates a client with a new connect token and starts it connecting.
+func (h *Harness) Connect(clientId uint64) (*netcode.Client, error) {
+	token, err := h.ConnectToken(clientId)
+	if err != nil {
+		return nil, err
+	}
+	return h.ConnectWithToken(token)
+}
+
+// Creates a client on the next free address, 10.0.1.1:50000 onwards, and starts it connecting
+// with the token.
+func (h *Harness) ConnectWithToken(token *netcode.ConnectToken) (*netcode.Client, error) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.1.1"), Port: 50000 + len(h.Clients)}
+	transport, err := h.Network.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// each simulator uses two seeds, one per direction
+	sim := netcode.NewNetworkSimulator(transport, h.config.Seed+2*int64(len(h.Clients)+1))
+	sim.SetClock(h.Clock)
+
+	client := netcode.NewClient(token)
+	client.SetTransport(sim)
+	client.SetClock(h.Clock)
+	if err := client.Connect(); err != nil {
+		sim.Close()
+		return nil, err
+	}
+	h.Clients = append(h.Clients, client)
+	h.ClientNetworks = append(h.ClientNetworks, sim)
+	return client, nil
+}
+
+// Seconds since the harness started, the time last passed to Update.
+func (h *Harness) Time() float64 {
+	return h.time
+}
+
+// Advances the clock by dt then updates every client and the server, returning an error if
+// packets were not handed over in time or the server has stopped. Packets sent between steps,
+// such as payloads, are processed by this step.
+func (h *Harness) Step(dt time.Duration) error {
+	if err := h.deliver(); err != nil {
+		return err
+	}
+
+	h.Clock.Advance(dt)
+	h.time += dt.Seconds()
+	if err := h.deliver(); err != nil {
+		return err
+	}
+
+	for _, client := range h.Clients {
+		client.Update(h.time)
+	}
+
+	if err := h.deliver(); err != nil {
+		return err
+	}
+
+	if err := h.Server.Update(h.time); err != nil {
+		return err
+	}
+	return h.deliver()
+}
+
+// delivers the packets due at the clock's time and waits for them to be handed to their server
+// or client. Sent packets reach the receiving simulator first, then are delivered again from it.
+func (h *Harness) deliver() error {
+	sims := append([]*netcode.NetworkSimulator{h.ServerNetwork}, h.ClientNetworks...)
+	for _, sim := range sims {
+		sim.Deliver()
+	}
+
+	if !h.Network.WaitDelivered(DELIVERY_TIMEOUT) {
+		return errors.New("timed out waiting for packets to be delivered")
+	}
+
+	for _, sim := range sims {
+		sim.Deliver()
+	}
+
+	for _, sim := range sims {
+		if !sim.WaitDelivered(DELIVERY_TIMEOUT) {
+			return errors.New("timed out waiting for received packets to be delivered")
+		}
+	}
+	return nil
+}
+
+// Steps by dt until done returns true, returning false if it has not after maxSteps.
+func (h *Harness) StepUntil(dt time.Duration, maxSteps int, done func() bool) (bool, error) {
+	for i := 0; i < maxSteps; i += 1 {
+		if done() {
+			return true, nil
+		}
+
+		if err := h.Step(dt); err != nil {
+			return false, err
+		}
+	}
+	return done(), nil
+}
+
+// Closes every client and stops the server.
+func (h *Harness) Close() {
+	for _, client := range h.Clients {
+		client.Close()
+	}
+	h.Server.Stop()
+}
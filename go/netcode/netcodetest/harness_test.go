@@ -0,0 +1,184 @@
+package netcodetest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/networkprotocol/netcode.io/go/netcode"
+)
+
+const TEST_CLIENT_ID = 0x1
+
+func testNewHarness(t *testing.T) *Harness {
+	h, err := New(DefaultConfig())
+	if err != nil {
+		t.Fatalf("error creating harness: %s\n", err)
+	}
+	return h
+}
+
+// connects count clients and returns the number of 100ms steps it took.
+func testConnectClients(h *Harness, count int, t *testing.T) int {
+	for i := 0; i < count; i += 1 {
+		if _, err := h.Connect(TEST_CLIENT_ID + uint64(i)); err != nil {
+			t.Fatalf("error connecting client: %s\n", err)
+		}
+	}
+
+	steps := 0
+	connected, err := h.StepUntil(100*time.Millisecond, 100, func() bool {
+		steps++
+		for _, client := range h.Clients {
+			if client.GetState() != netcode.StateConnected {
+				return false
+			}
+		}
+		return true
+	})
+
+	if err != nil {
+		t.Fatalf("error stepping harness: %s\n", err)
+	}
+
+	if !connected {
+		t.Fatalf("expected %d clients to connect\n", count)
+	}
+	return steps
+}
+
+func TestHarnessConnect(t *testing.T) {
+	h := testNewHarness(t)
+	defer h.Close()
+
+	steps := testConnectClients(h, 4, t)
+	if len(h.Server.GetConnectedClientIds()) != 4 {
+		t.Fatalf("expected 4 connected clients got %d\n", len(h.Server.GetConnectedClientIds()))
+	}
+
+	for _, client := range h.Clients {
+		client.SendData([]byte{1, 2, 3, 4})
+	}
+	h.Server.SendPayloads([]byte{5, 6, 7, 8}, h.Time())
+
+	if err := h.Step(100 * time.Millisecond); err != nil {
+		t.Fatalf("error stepping harness: %s\n", err)
+	}
+
+	for clientIndex := 0; clientIndex < 4; clientIndex += 1 {
+		if data, _ := h.Server.RecvPayload(clientIndex); len(data) != 4 {
+			t.Fatalf("expected server to receive payload from client %d\n", clientIndex)
+		}
+	}
+
+	for i, client := range h.Clients {
+		if data, _ := client.RecvData(); len(data) != 4 {
+			t.Fatalf("expected client %d to receive payload from server\n", i)
+		}
+	}
+
+	// the handshake takes the same number of steps every run
+	other := testNewHarness(t)
+	defer other.Close()
+	if otherSteps := testConnectClients(other, 4, t); otherSteps != steps {
+		t.Fatalf("expected clients to connect in %d steps got %d\n", steps, otherSteps)
+	}
+}
+
+func TestHarnessNetworkConditions(t *testing.T) {
+	h := testNewHarness(t)
+	defer h.Close()
+	steps := testConnectClients(h, 1, t)
+
+	// each packet now takes 3 steps each way, on the clock rather than the system time
+	slow := testNewHarness(t)
+	defer slow.Close()
+	latency := netcode.NetworkConditions{Latency: 300 * time.Millisecond}
+	slow.ServerNetwork.SetConditions(latency, latency)
+	slowSteps := testConnectClients(slow, 1, t)
+	if slowSteps <= steps {
+		t.Fatalf("expected latency to slow the handshake from %d steps got %d\n", steps, slowSteps)
+	}
+
+	other := testNewHarness(t)
+	defer other.Close()
+	other.ServerNetwork.SetConditions(latency, latency)
+	if otherSteps := testConnectClients(other, 1, t); otherSteps != slowSteps {
+		t.Fatalf("expected clients to connect in %d steps got %d\n", slowSteps, otherSteps)
+	}
+}
+
+func TestHarnessServerTimeout(t *testing.T) {
+	h := testNewHarness(t)
+	defer h.Close()
+	h.Server.SetTimeout(2 * time.Second)
+
+	testConnectClients(h, 1, t)
+
+	// the client goes quiet without telling the server, it last sent a keep-alive within 0.5s
+	h.Clients[0].Disconnect(netcode.StateDisconnected, false)
+	lastHeard := h.Time()
+
+	for h.Time() < lastHeard+1.5 {
+		if err := h.Step(100 * time.Millisecond); err != nil {
+			t.Fatalf("error stepping harness: %s\n", err)
+		}
+	}
+
+	if len(h.Server.GetConnectedClientIds()) != 1 {
+		t.Fatalf("expected client to be connected before the timeout\n")
+	}
+
+	for h.Time() < lastHeard+2.5 {
+		if err := h.Step(100 * time.Millisecond); err != nil {
+			t.Fatalf("error stepping harness: %s\n", err)
+		}
+	}
+
+	if len(h.Server.GetConnectedClientIds()) != 0 {
+		t.Fatalf("expected client to have timed out after 2 seconds\n")
+	}
+}
+
+func TestHarnessTokenExpiry(t *testing.T) {
+	h := testNewHarness(t)
+	defer h.Close()
+
+	expired, err := h.ConnectToken(TEST_CLIENT_ID)
+	if err != nil {
+		t.Fatalf("error generating connect token: %s\n", err)
+	}
+
+	// only the wall clock moves, so the server sees the token expired but the client does not
+	h.Clock.Set(time.Unix(int64(expired.ExpireTimestamp)+1, 0))
+	client, err := h.ConnectWithToken(expired)
+	if err != nil {
+		t.Fatalf("error connecting client: %s\n", err)
+	}
+
+	for i := 0; i < 10; i += 1 {
+		if err := h.Step(100 * time.Millisecond); err != nil {
+			t.Fatalf("error stepping harness: %s\n", err)
+		}
+	}
+
+	if client.GetState() != netcode.StateSendingConnectionRequest {
+		t.Fatalf("expected server to ignore requests with an expired token got state: %d\n", client.GetState())
+	}
+
+	if h.Server.Stats().PacketsReceived == 0 {
+		t.Fatalf("expected server to receive connection requests\n")
+	}
+
+	// a token created at the new time connects
+	if _, err := h.Connect(TEST_CLIENT_ID + 1); err != nil {
+		t.Fatalf("error connecting client: %s\n", err)
+	}
+
+	connected, err := h.StepUntil(100*time.Millisecond, 20, func() bool {
+		return h.Clients[1].GetState() == netcode.StateConnected
+	})
+
+	if err != nil || !connected {
+		t.Fatalf("expected client with an unexpired token to connect\n")
+	}
+}
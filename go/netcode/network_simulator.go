@@ -0,0 +1,418 @@
+package netcode
+
+import (
+	"container/heap"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conditions the NetworkSimulator applies to packets travelling in one direction.
+type NetworkConditions struct {
+	Latency      time.Duration // delay added to every packet
+	Jitter       time.Duration // random delay of up to +/- Jitter added to the latency
+	PacketLoss   float64       // fraction of packets dropped, [0,1]
+	Duplicates   float64       // fraction of packets delivered twice, [0,1]
+	Reorder      float64       // fraction of packets held back by ReorderDelay so later packets overtake them, [0,1]
+	ReorderDelay time.Duration
+	Bandwidth    int // bytes per second the link carries, packets queue behind each other once exceeded. 0 is unlimited
+}
+
+// Wraps a Transport to simulate a bad network on its send and receive paths, such as a
+// *net.UDPConn or MemoryTransport given to Server.SetTransport or Client.SetTransport.
+// Conditions are set per direction, and optionally per peer address. Each direction draws from
+// its own random source seeded from the seed, so the same packets in the same order are
+// always treated the same way.
+type NetworkSimulator struct {
+	transport Transport
+	send      *simulatorQueue
+	recv      *simulatorQueue
+	readyCh   chan *simulatedPacket // received packets which have been delayed, read by ReadFrom
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	readErr   error // set by the reading goroutine before it closes readDone
+	readDone  chan struct{}
+
+	mu        sync.Mutex
+	inFlight  int        // packets on readyCh or being handled by the reader, see WaitDelivered
+	delivered *sync.Cond // signalled when inFlight reaches 0 or the simulator is closed
+	closed    bool
+	reading   int32 // set atomically while the reader handles the last packet read
+}
+
+func NewNetworkSimulator(transport Transport, seed int64) *NetworkSimulator {
+	s := &NetworkSimulator{transport: transport}
+	s.closeCh = make(chan struct{})
+	s.readDone = make(chan struct{})
+	s.readyCh = make(chan *simulatedPacket, MEMORY_TRANSPORT_QUEUE_SIZE)
+	s.delivered = sync.NewCond(&s.mu)
+	s.send = newSimulatorQueue(seed, s.closeCh, s.deliverSend)
+	s.recv = newSimulatorQueue(seed+1, s.closeCh, s.deliverRecv)
+	go s.send.run()
+	go s.recv.run()
+	go s.readLoop()
+	return s
+}
+
+// Sets the conditions for packets sent and received from peers without their own conditions.
+func (s *NetworkSimulator) SetConditions(send, recv NetworkConditions) {
+	s.send.setConditions(nil, send)
+	s.recv.setConditions(nil, recv)
+}
+
+// Sets the conditions for packets sent to and received from the peer, replacing the conditions
+// set with SetConditions for that peer.
+func (s *NetworkSimulator) SetPeerConditions(peer *net.UDPAddr, send, recv NetworkConditions) {
+	s.send.setConditions(peer, send)
+	s.recv.setConditions(peer, recv)
+}
+
+// Sets the clock packets are delayed by. With the system clock packets are delivered as they
+// become due. With any other clock, such as a ManualClock, they are only delivered by Deliver,
+// so a test decides when they arrive. Should be called before any packets are sent.
+func (s *NetworkSimulator) SetClock(clock Clock) {
+	clock = clockOrSystem(clock)
+	s.send.setClock(clock)
+	s.recv.setClock(clock)
+}
+
+// Delivers the packets due at the clock's current time, needed when the clock is not the system
+// clock. Sent packets have been written to the wrapped transport when it returns, received
+// packets are handed to ReadFrom, see WaitDelivered.
+func (s *NetworkSimulator) Deliver() {
+	s.send.deliverDue()
+	s.recv.deliverDue()
+}
+
+// Waits until every received packet handed to ReadFrom has been handled by its reader, or the
+// simulator is closed, returning false if the timeout passes first. Like
+// MemoryNetwork.WaitDelivered a packet is handled once the reader calls ReadFrom again.
+func (s *NetworkSimulator) WaitDelivered(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		s.mu.Lock()
+		s.delivered.Broadcast()
+		s.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.inFlight > 0 && !s.closed {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		s.delivered.Wait()
+	}
+	return true
+}
+
+func (s *NetworkSimulator) handled() {
+	s.mu.Lock()
+	s.inFlight--
+	if s.inFlight == 0 {
+		s.delivered.Broadcast()
+	}
+	s.mu.Unlock()
+}
+
+func (s *NetworkSimulator) ReadFrom(b []byte) (int, net.Addr, error) {
+	if atomic.CompareAndSwapInt32(&s.reading, 1, 0) {
+		s.handled()
+	}
+
+	select {
+	case packet := <-s.readyCh:
+		atomic.StoreInt32(&s.reading, 1)
+		return copy(b, packet.data), packet.addr, nil
+	case <-s.readDone:
+		return 0, nil, s.readErr
+	case <-s.closeCh:
+		return 0, nil, errors.New("network simulator has been closed")
+	}
+}
+
+func (s *NetworkSimulator) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-s.closeCh:
+		return 0, errors.New("network simulator has been closed")
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("network simulator requires a *net.UDPAddr")
+	}
+	s.send.add(b, to)
+	return len(b), nil
+}
+
+// Closes the simulator and the transport it wraps, packets still being delayed are dropped.
+func (s *NetworkSimulator) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		err = s.transport.Close()
+
+		s.mu.Lock()
+		s.closed = true
+		s.delivered.Broadcast()
+		s.mu.Unlock()
+	})
+	return err
+}
+
+func (s *NetworkSimulator) LocalAddr() net.Addr {
+	return s.transport.LocalAddr()
+}
+
+// reads from the wrapped transport until it is closed, delaying each packet by the recv conditions.
+func (s *NetworkSimulator) readLoop() {
+	buf := make([]byte, MAX_PACKET_BYTES)
+	for {
+		n, addr, err := s.transport.ReadFrom(buf)
+		if err != nil {
+			s.readErr = err
+			close(s.readDone)
+			return
+		}
+
+		from, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		s.recv.add(buf[:n], from)
+	}
+}
+
+func (s *NetworkSimulator) deliverSend(packet *simulatedPacket) {
+	s.transport.WriteTo(packet.data, packet.addr)
+}
+
+func (s *NetworkSimulator) deliverRecv(packet *simulatedPacket) {
+	s.mu.Lock()
+	s.inFlight++
+	s.mu.Unlock()
+
+	select {
+	case s.readyCh <- packet:
+	case <-s.closeCh:
+		s.handled()
+	}
+}
+
+type simulatedPacket struct {
+	data        []byte
+	addr        *net.UDPAddr
+	deliverTime time.Time
+	order       uint64 // packets due at the same time are delivered in the order they were added
+}
+
+type simulatedPacketHeap []*simulatedPacket
+
+func (h simulatedPacketHeap) Len() int { return len(h) }
+
+func (h simulatedPacketHeap) Less(i, j int) bool {
+	if h[i].deliverTime.Equal(h[j].deliverTime) {
+		return h[i].order < h[j].order
+	}
+	return h[i].deliverTime.Before(h[j].deliverTime)
+}
+
+func (h simulatedPacketHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *simulatedPacketHeap) Push(x interface{}) {
+	*h = append(*h, x.(*simulatedPacket))
+}
+
+func (h *simulatedPacketHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	packet := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return packet
+}
+
+// a simulated link for one direction, a peer with its own conditions also has its own link so
+// its bandwidth is not shared.
+type simulatorLink struct {
+	conditions NetworkConditions
+	busyUntil  time.Time // when the link has finished carrying the packets already queued on it
+}
+
+// Packets travelling in one direction, held until their delivery time.
+type simulatorQueue struct {
+	mu        sync.Mutex
+	clock     Clock
+	realTime  bool // the clock is the system clock, so run delivers packets as they become due
+	rand      *rand.Rand
+	link      simulatorLink
+	peerLinks map[addrKey]*simulatorLink
+	packets   simulatedPacketHeap
+	order     uint64
+
+	wakeCh    chan struct{}
+	closeCh   chan struct{}
+	deliverFn func(packet *simulatedPacket)
+}
+
+func newSimulatorQueue(seed int64, closeCh chan struct{}, deliverFn func(packet *simulatedPacket)) *simulatorQueue {
+	q := &simulatorQueue{}
+	q.clock = systemClock{}
+	q.realTime = true
+	q.rand = rand.New(rand.NewSource(seed))
+	q.peerLinks = make(map[addrKey]*simulatorLink)
+	q.wakeCh = make(chan struct{}, 1)
+	q.closeCh = closeCh
+	q.deliverFn = deliverFn
+	return q
+}
+
+func (q *simulatorQueue) setClock(clock Clock) {
+	q.mu.Lock()
+	q.clock = clock
+	_, q.realTime = clock.(systemClock)
+	q.mu.Unlock()
+	q.wake()
+}
+
+func (q *simulatorQueue) wake() {
+	select {
+	case q.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (q *simulatorQueue) setConditions(peer *net.UDPAddr, conditions NetworkConditions) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if peer == nil {
+		q.link.conditions = conditions
+		return
+	}
+
+	key := newAddrKey(peer)
+	if link, ok := q.peerLinks[key]; ok {
+		link.conditions = conditions
+		return
+	}
+	q.peerLinks[key] = &simulatorLink{conditions: conditions}
+}
+
+// applies the link's conditions to the packet, queuing a copy of it for each delivery.
+func (q *simulatorQueue) add(data []byte, addr *net.UDPAddr) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now()
+	link := &q.link
+	if peerLink, ok := q.peerLinks[newAddrKey(addr)]; ok {
+		link = peerLink
+	}
+	conditions := &link.conditions
+
+	if q.rand.Float64() < conditions.PacketLoss {
+		return
+	}
+
+	// the packet leaves once the link has carried those queued before it
+	sendTime := now
+	if conditions.Bandwidth > 0 {
+		if link.busyUntil.After(sendTime) {
+			sendTime = link.busyUntil
+		}
+		sendTime = sendTime.Add(time.Duration(len(data)) * time.Second / time.Duration(conditions.Bandwidth))
+		link.busyUntil = sendTime
+	}
+
+	copies := 1
+	if q.rand.Float64() < conditions.Duplicates {
+		copies = 2
+	}
+
+	for i := 0; i < copies; i += 1 {
+		delay := conditions.Latency
+		if conditions.Jitter > 0 {
+			delay += time.Duration((q.rand.Float64()*2 - 1) * float64(conditions.Jitter))
+		}
+
+		if q.rand.Float64() < conditions.Reorder {
+			delay += conditions.ReorderDelay
+		}
+
+		if delay < 0 {
+			delay = 0
+		}
+
+		packet := &simulatedPacket{addr: addr, deliverTime: sendTime.Add(delay), order: q.order}
+		packet.data = make([]byte, len(data))
+		copy(packet.data, data)
+		q.order++
+		heap.Push(&q.packets, packet)
+	}
+	q.wake()
+}
+
+// delivers the packets due at the clock's current time in order.
+func (q *simulatorQueue) deliverDue() {
+	q.mu.Lock()
+	now := q.clock.Now()
+	var due []*simulatedPacket
+	for len(q.packets) > 0 && !q.packets[0].deliverTime.After(now) {
+		due = append(due, heap.Pop(&q.packets).(*simulatedPacket))
+	}
+	q.mu.Unlock()
+
+	for _, packet := range due {
+		q.deliverFn(packet)
+	}
+}
+
+// delivers packets as they become due until the simulator is closed. Other clocks do not move
+// with the system time, so their packets are left for deliverDue.
+func (q *simulatorQueue) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		q.mu.Lock()
+		var wait time.Duration = -1
+		var packet *simulatedPacket
+		if q.realTime && len(q.packets) > 0 {
+			wait = q.packets[0].deliverTime.Sub(q.clock.Now())
+			if wait <= 0 {
+				packet = heap.Pop(&q.packets).(*simulatedPacket)
+			}
+		}
+		q.mu.Unlock()
+
+		if packet != nil {
+			q.deliverFn(packet)
+			continue
+		}
+
+		var timerCh <-chan time.Time
+		if wait > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(wait)
+			timerCh = timer.C
+		}
+
+		select {
+		case <-q.wakeCh:
+		case <-timerCh:
+		case <-q.closeCh:
+			return
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// sends count packets of size bytes starting with their sequence through a simulator to a
+// receiving transport and returns the sequences in the order they arrived.
+func testSimulatorDelivery(seed int64, conditions NetworkConditions, count, size int, t *testing.T) []byte {
+	network := NewMemoryNetwork()
+	fromAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	toAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+
+	from, err := network.Listen(fromAddr)
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	to, err := network.Listen(toAddr)
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+	defer to.Close()
+
+	sim := NewNetworkSimulator(from, seed)
+	defer sim.Close()
+	sim.SetConditions(conditions, NetworkConditions{})
+
+	for i := 0; i < count; i += 1 {
+		packet := make([]byte, size)
+		packet[0] = byte(i)
+		if _, err := sim.WriteTo(packet, toAddr); err != nil {
+			t.Fatalf("error writing to simulator: %s\n", err)
+		}
+	}
+
+	return testReadUntilQuiet(to, 100*time.Millisecond)
+}
+
+// reads the first byte of each packet until none arrives for the quiet period.
+func testReadUntilQuiet(transport Transport, quiet time.Duration) []byte {
+	recvCh := make(chan byte, MEMORY_TRANSPORT_QUEUE_SIZE)
+	go func() {
+		buf := make([]byte, MAX_PACKET_BYTES)
+		for {
+			n, _, err := transport.ReadFrom(buf)
+			if err != nil {
+				close(recvCh)
+				return
+			}
+			if n > 0 {
+				recvCh <- buf[0]
+			}
+		}
+	}()
+
+	received := make([]byte, 0)
+	for {
+		select {
+		case sequence, ok := <-recvCh:
+			if !ok {
+				return received
+			}
+			received = append(received, sequence)
+		case <-time.After(quiet):
+			return received
+		}
+	}
+}
+
+func TestNetworkSimulatorDeterministic(t *testing.T) {
+	conditions := NetworkConditions{PacketLoss: 0.3, Duplicates: 0.2}
+
+	first := testSimulatorDelivery(1, conditions, 200, 1, t)
+	second := testSimulatorDelivery(1, conditions, 200, 1, t)
+	if string(first) != string(second) {
+		t.Fatalf("expected the same seed to deliver the same packets\n%v\n%v\n", first, second)
+	}
+
+	if len(first) < 100 || len(first) > 200 {
+		t.Fatalf("expected roughly 70%% of packets plus duplicates delivered got %d\n", len(first))
+	}
+
+	other := testSimulatorDelivery(2, conditions, 200, 1, t)
+	if string(first) == string(other) {
+		t.Fatalf("expected a different seed to deliver different packets\n")
+	}
+}
+
+func TestNetworkSimulatorConditions(t *testing.T) {
+	all := testSimulatorDelivery(1, NetworkConditions{Duplicates: 1}, 10, 1, t)
+	if len(all) != 20 {
+		t.Fatalf("expected every packet duplicated got %d packets\n", len(all))
+	}
+
+	none := testSimulatorDelivery(1, NetworkConditions{PacketLoss: 1}, 10, 1, t)
+	if len(none) != 0 {
+		t.Fatalf("expected every packet lost got %d packets\n", len(none))
+	}
+
+	reordered := testSimulatorDelivery(1, NetworkConditions{Reorder: 0.5, ReorderDelay: 20 * time.Millisecond}, 20, 1, t)
+	if len(reordered) != 20 {
+		t.Fatalf("expected every reordered packet delivered got %d packets\n", len(reordered))
+	}
+
+	inOrder := true
+	for i := 1; i < len(reordered); i += 1 {
+		if reordered[i] < reordered[i-1] {
+			inOrder = false
+		}
+	}
+
+	if inOrder {
+		t.Fatalf("expected packets to be reordered got %v\n", reordered)
+	}
+
+	start := time.Now()
+	delayed := testSimulatorDelivery(1, NetworkConditions{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}, 5, 1, t)
+	if len(delayed) != 5 {
+		t.Fatalf("expected every delayed packet delivered got %d packets\n", len(delayed))
+	}
+
+	// the read waits a further 100ms after the last packet arrives
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Fatalf("expected packets to be delayed by at least 40ms got %s\n", elapsed-100*time.Millisecond)
+	}
+
+	// 10 packets of 1000 bytes at 50000 bytes per second take 200ms to send
+	start = time.Now()
+	limited := testSimulatorDelivery(1, NetworkConditions{Bandwidth: 50000}, 10, 1000, t)
+	if len(limited) != 10 {
+		t.Fatalf("expected every packet delivered under the bandwidth cap got %d packets\n", len(limited))
+	}
+
+	if elapsed := time.Since(start); elapsed < 280*time.Millisecond {
+		t.Fatalf("expected bandwidth cap to delay packets by at least 180ms got %s\n", elapsed-100*time.Millisecond)
+	}
+}
+
+func TestNetworkSimulatorPeerConditions(t *testing.T) {
+	network := NewMemoryNetwork()
+	simAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	lossyAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	goodAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.3"), Port: 40000}
+
+	simTransport, _ := network.Listen(simAddr)
+	lossy, _ := network.Listen(lossyAddr)
+	good, _ := network.Listen(goodAddr)
+	defer lossy.Close()
+	defer good.Close()
+
+	sim := NewNetworkSimulator(simTransport, 1)
+	defer sim.Close()
+	sim.SetPeerConditions(lossyAddr, NetworkConditions{PacketLoss: 1}, NetworkConditions{PacketLoss: 1})
+
+	for i := 0; i < 10; i += 1 {
+		sim.WriteTo([]byte{byte(i)}, lossyAddr)
+		sim.WriteTo([]byte{byte(i)}, goodAddr)
+		lossy.WriteTo([]byte{byte(i)}, simAddr)
+		good.WriteTo([]byte{byte(i)}, simAddr)
+	}
+
+	if n := len(testReadUntilQuiet(lossy, 50*time.Millisecond)); n != 0 {
+		t.Fatalf("expected packets sent to lossy peer to be lost got %d\n", n)
+	}
+
+	if n := len(testReadUntilQuiet(good, 50*time.Millisecond)); n != 10 {
+		t.Fatalf("expected packets sent to good peer to be delivered got %d\n", n)
+	}
+
+	// only the good peer's packets are received
+	if n := len(testReadUntilQuiet(sim, 50*time.Millisecond)); n != 10 {
+		t.Fatalf("expected only packets from good peer to be received got %d\n", n)
+	}
+}
+
+func TestNetworkSimulatorManualClock(t *testing.T) {
+	network := NewMemoryNetwork()
+	clock := NewManualClock(time.Unix(1500000000, 0))
+	toAddr := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+
+	from, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000})
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	to, err := network.Listen(toAddr)
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	sender := NewNetworkSimulator(from, 1)
+	defer sender.Close()
+	sender.SetClock(clock)
+	sender.SetConditions(NetworkConditions{Latency: 100 * time.Millisecond}, NetworkConditions{})
+
+	receiver := NewNetworkSimulator(to, 2)
+	defer receiver.Close()
+	receiver.SetClock(clock)
+	receiver.SetConditions(NetworkConditions{}, NetworkConditions{Latency: 50 * time.Millisecond})
+
+	if _, err := sender.WriteTo([]byte{1, 2, 3, 4}, toAddr); err != nil {
+		t.Fatalf("error writing to simulator: %s\n", err)
+	}
+
+	// packets only move when the clock does
+	time.Sleep(200 * time.Millisecond)
+	sender.Deliver()
+	if !network.WaitDelivered(time.Second) || len(to.recvCh) != 0 {
+		t.Fatalf("expected packet to be held until the clock reaches its latency\n")
+	}
+
+	clock.Advance(100 * time.Millisecond)
+	sender.Deliver()
+	if !network.WaitDelivered(time.Second) {
+		t.Fatalf("expected packet to be sent once the clock reached its latency\n")
+	}
+
+	receiver.Deliver()
+	if len(receiver.readyCh) != 0 {
+		t.Fatalf("expected received packet to be held until the clock reaches its latency\n")
+	}
+
+	clock.Advance(50 * time.Millisecond)
+	receiver.Deliver()
+	buf := make([]byte, MAX_PACKET_BYTES)
+	if n, _, err := receiver.ReadFrom(buf); err != nil || n != 4 {
+		t.Fatalf("expected to read the delayed packet got %d bytes err: %v\n", n, err)
+	}
+
+	// the packet is handled once the reader asks for the next one
+	go receiver.ReadFrom(buf)
+	if !receiver.WaitDelivered(time.Second) {
+		t.Fatalf("expected received packet to be handled\n")
+	}
+}
+
+func TestNetworkSimulatorClientServer(t *testing.T) {
+	network := NewMemoryNetwork()
+	addr := net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	serverTransport, err := network.Listen(&addr)
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	bad := NetworkConditions{Latency: 20 * time.Millisecond, Jitter: 10 * time.Millisecond, PacketLoss: 0.1, Duplicates: 0.1}
+	serverSim := NewNetworkSimulator(serverTransport, 1)
+	serverSim.SetConditions(bad, bad)
+
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.SetTransport(serverSim)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	clientTransport, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000})
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	client := NewClient(testGenerateConnectToken([]net.UDPAddr{addr}, TEST_PRIVATE_KEY, t))
+	client.SetTransport(NewNetworkSimulator(clientTransport, 2))
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	defer client.Close()
+
+	clientTime := float64(0)
+	payloads := 0
+	for i := 0; i < 300 && payloads < 10; i += 1 {
+		client.Update(clientTime)
+		if client.GetState() == StateConnected {
+			client.SendData([]byte{1, 2, 3, 4})
+		}
+
+		serv.Update(serv.serverTime + 0.01)
+		for {
+			data, _ := serv.RecvPayload(0)
+			if len(data) == 0 {
+				break
+			}
+			payloads++
+		}
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+	}
+
+	if payloads < 10 {
+		t.Fatalf("expected payloads over the simulated network got %d client state: %s\n", payloads, clientStateMap[client.GetState()])
+	}
+}
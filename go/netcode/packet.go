@@ -53,6 +53,24 @@ var packetTypeMap = map[PacketType]string{
 // not a packet type, but value is last packetType+1
 const ConnectionNumPackets = ConnectionDisconnect + 1
 
+// Returned from Read when the packet (or connect token) fails authentication
+type decryptError struct {
+	msg string
+}
+
+func (e *decryptError) Error() string {
+	return e.msg
+}
+
+// Returned from Read when the replay protection has already seen the packet sequence
+type replayError struct {
+	sequence uint64
+}
+
+func (e *replayError) Error() string {
+	return "ignored connection payload packet. sequence " + strconv.FormatUint(e.sequence, 10) + " already received (replay protection)"
+}
+
 // Packet interface supporting reading and writing.
 type Packet interface {
 	GetType() PacketType                                                                                                                                                    // The type of packet
@@ -61,6 +79,29 @@ type Packet interface {
 	Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error // reads in and decrypts from the supplied buffer to set the packet properties
 }
 
+// Packets encrypted with the session keys, which can be written and read with a session's cached cipher.
+type sessionPacket interface {
+	Packet
+	write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error)
+	read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error
+}
+
+// Writes the packet with the session's cached cipher, packets not encrypted with the session keys use Write.
+func writeSessionPacket(packet Packet, buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
+	if p, ok := packet.(sessionPacket); ok {
+		return p.write(buf, protocolId, sequence, writePacketKey, crypto)
+	}
+	return packet.Write(buf, protocolId, sequence, writePacketKey)
+}
+
+// Reads the packet with the session's cached cipher, packets not encrypted with the session keys use Read.
+func readSessionPacket(packet Packet, packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
+	if p, ok := packet.(sessionPacket); ok {
+		return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
+	}
+	return packet.Read(packetData, packetLen, protocolId, currentTimestamp, readPacketKey, privateKey, allowedPackets, replayProtection)
+}
+
 // Returns the type of packet given packetbuffer by peaking the packet type
 func NewPacket(packetBuffer []byte) Packet {
 	var packetType PacketType
@@ -171,7 +212,7 @@ func (p *RequestPacket) Read(packetData []byte, packetLen int, protocolId, curre
 
 	p.Token = NewConnectTokenPrivateEncrypted(tokenBuffer)
 	if _, err := p.Token.Decrypt(p.ProtocolId, p.ConnectTokenExpireTimestamp, p.ConnectTokenSequence, privateKey); err != nil {
-		return errors.New("error decrypting connect token private data: " + err.Error())
+		return &decryptError{"error decrypting connect token private data: " + err.Error()}
 	}
 
 	if err := p.Token.Read(); err != nil {
@@ -195,6 +236,10 @@ func (p *DeniedPacket) Sequence() uint64 {
 }
 
 func (p *DeniedPacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *DeniedPacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
@@ -203,12 +248,16 @@ func (p *DeniedPacket) Write(buf []byte, protocolId, sequence uint64, writePacke
 	}
 
 	// denied packets are empty
-	return encryptPacket(buffer, buffer.Pos, buffer.Pos, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, buffer.Pos, buffer.Pos, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *DeniedPacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *DeniedPacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -236,6 +285,10 @@ func (p *ChallengePacket) Sequence() uint64 {
 }
 
 func (p *ChallengePacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *ChallengePacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
 	if err != nil {
@@ -246,12 +299,16 @@ func (p *ChallengePacket) Write(buf []byte, protocolId, sequence uint64, writePa
 	buffer.WriteUint64(p.ChallengeTokenSequence)
 	buffer.WriteBytesN(p.ChallengeTokenData, CHALLENGE_TOKEN_BYTES)
 	encryptedFinish := buffer.Pos
-	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *ChallengePacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *ChallengePacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -290,6 +347,10 @@ func (p *ResponsePacket) Sequence() uint64 {
 }
 
 func (p *ResponsePacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *ResponsePacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
 	if err != nil {
@@ -300,12 +361,16 @@ func (p *ResponsePacket) Write(buf []byte, protocolId, sequence uint64, writePac
 	buffer.WriteUint64(p.ChallengeTokenSequence)
 	buffer.WriteBytesN(p.ChallengeTokenData, CHALLENGE_TOKEN_BYTES)
 	encryptedFinish := buffer.Pos
-	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *ResponsePacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *ResponsePacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -344,6 +409,10 @@ func (p *KeepAlivePacket) Sequence() uint64 {
 }
 
 func (p *KeepAlivePacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *KeepAlivePacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
 	if err != nil {
@@ -354,12 +423,16 @@ func (p *KeepAlivePacket) Write(buf []byte, protocolId, sequence uint64, writePa
 	buffer.WriteUint32(uint32(p.ClientIndex))
 	buffer.WriteUint32(uint32(p.MaxClients))
 	encryptedFinish := buffer.Pos
-	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *KeepAlivePacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *KeepAlivePacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -391,6 +464,7 @@ type PayloadPacket struct {
 	sequence     uint64
 	PayloadBytes uint32
 	PayloadData  []byte
+	pooled       bool // PayloadData is owned by the packet, which is returned to the pool by Release
 }
 
 func (p *PayloadPacket) GetType() PacketType {
@@ -410,6 +484,10 @@ func (p *PayloadPacket) Sequence() uint64 {
 }
 
 func (p *PayloadPacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *PayloadPacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
 	if err != nil {
@@ -418,12 +496,16 @@ func (p *PayloadPacket) Write(buf []byte, protocolId, sequence uint64, writePack
 	encryptedStart := buffer.Pos
 	buffer.WriteBytesN(p.PayloadData, int(p.PayloadBytes))
 	encryptedFinish := buffer.Pos
-	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, encryptedStart, encryptedFinish, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *PayloadPacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *PayloadPacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -438,11 +520,33 @@ func (p *PayloadPacket) Read(packetData []byte, packetLen int, protocolId, curre
 		return errors.New("ignored connection payload packet. payload is too large")
 	}
 
+	// copied so the datagram buffer can be reused once the packet has been read
 	p.PayloadBytes = decryptedSize
-	p.PayloadData = decryptedBuf.Bytes()
+	p.PayloadData = append(p.PayloadData[:0], decryptedBuf.Bytes()...)
 	return nil
 }
 
+// Returns a payload from RecvPayloadPacket to the pool so its buffer can be reused.
+// PayloadData must not be used after calling Release, and Release must only be called once.
+func (p *PayloadPacket) Release() {
+	if !p.pooled {
+		return
+	}
+	p.sequence = 0
+	p.PayloadBytes = 0
+	p.PayloadData = p.PayloadData[:0]
+	payloadPacketPool.Put(p)
+}
+
+// returns a copy of the payload and its sequence, then releases the packet.
+func (p *PayloadPacket) copyAndRelease() ([]byte, uint64) {
+	payloadData := make([]byte, len(p.PayloadData))
+	copy(payloadData, p.PayloadData)
+	sequence := p.sequence
+	p.Release()
+	return payloadData, sequence
+}
+
 // Signals to server/client to disconnect, contains no data.
 type DisconnectPacket struct {
 	sequence uint64
@@ -453,6 +557,10 @@ func (p *DisconnectPacket) Sequence() uint64 {
 }
 
 func (p *DisconnectPacket) Write(buf []byte, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+	return p.write(buf, protocolId, sequence, writePacketKey, nil)
+}
+
+func (p *DisconnectPacket) write(buf []byte, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	buffer := NewBufferFromRef(buf)
 	prefixByte, err := writePacketPrefix(p, buffer, sequence)
 	if err != nil {
@@ -460,12 +568,16 @@ func (p *DisconnectPacket) Write(buf []byte, protocolId, sequence uint64, writeP
 	}
 
 	// denied packets are empty
-	return encryptPacket(buffer, buffer.Pos, buffer.Pos, prefixByte, protocolId, sequence, writePacketKey)
+	return encryptPacket(buffer, buffer.Pos, buffer.Pos, prefixByte, protocolId, sequence, writePacketKey, crypto)
 }
 
 func (p *DisconnectPacket) Read(packetData []byte, packetLen int, protocolId, currentTimestamp uint64, readPacketKey, privateKey, allowedPackets []byte, replayProtection *ReplayProtection) error {
+	return p.read(packetData, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, nil)
+}
+
+func (p *DisconnectPacket) read(packetData []byte, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) error {
 	packetBuffer := NewBufferFromRef(packetData)
-	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection)
+	sequence, decryptedBuf, err := decryptPacket(packetBuffer, packetLen, protocolId, readPacketKey, allowedPackets, replayProtection, crypto)
 	if err != nil {
 		return err
 	}
@@ -481,42 +593,45 @@ func (p *DisconnectPacket) GetType() PacketType {
 	return ConnectionDisconnect
 }
 
-// Decrypts the packet after reading in the prefix byte and sequence id. Used for all PacketTypes except RequestPacket. Returns a buffer containing the decrypted data
-func decryptPacket(packetBuffer *Buffer, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection) (uint64, *Buffer, error) {
+// Decrypts the packet after reading in the prefix byte and sequence id. Used for all PacketTypes except RequestPacket. Returns a buffer containing the decrypted data,
+// by value so reading a packet does not allocate. crypto is the session's cached cipher, or nil to create one for this packet.
+func decryptPacket(packetBuffer *Buffer, packetLen int, protocolId uint64, readPacketKey, allowedPackets []byte, replayProtection *ReplayProtection, crypto *packetCrypto) (uint64, Buffer, error) {
 	var packetSequence uint64
 
 	prefixByte, err := packetBuffer.GetUint8()
 	if err != nil {
-		return 0, nil, errors.New("invalid buffer length")
+		return 0, Buffer{}, errors.New("invalid buffer length")
 	}
 
 	if packetSequence, err = readSequence(packetBuffer, packetLen, prefixByte); err != nil {
-		return 0, nil, err
+		return 0, Buffer{}, err
 	}
 
 	if err := validateSequence(packetLen, prefixByte, packetSequence, readPacketKey, allowedPackets, replayProtection); err != nil {
-		return 0, nil, err
+		return 0, Buffer{}, err
 	}
 
 	// decrypt the per-packet type data
-	additionalData, nonce := packetCryptData(prefixByte, protocolId, packetSequence)
+	if crypto == nil {
+		crypto = &packetCrypto{}
+	}
 
 	encryptedSize := packetLen - packetBuffer.Pos
 	if encryptedSize < MAC_BYTES {
-		return 0, nil, errors.New("ignored encrypted packet. encrypted payload is too small")
+		return 0, Buffer{}, errors.New("ignored encrypted packet. encrypted payload is too small")
 	}
 
 	encryptedBuff, err := packetBuffer.GetBytes(encryptedSize)
 	if err != nil {
-		return 0, nil, errors.New("ignored encrypted packet. encrypted payload is too small")
+		return 0, Buffer{}, errors.New("ignored encrypted packet. encrypted payload is too small")
 	}
 
-	decryptedBuff, err := DecryptAead(encryptedBuff, additionalData, nonce, readPacketKey)
+	decryptedBuff, err := crypto.open(encryptedBuff, prefixByte, protocolId, packetSequence, readPacketKey)
 	if err != nil {
-		return 0, nil, errors.New("ignored encrypted packet. failed to decrypt: " + err.Error())
+		return 0, Buffer{}, &decryptError{"ignored encrypted packet. failed to decrypt: " + err.Error()}
 	}
 
-	return packetSequence, NewBufferFromRef(decryptedBuff), nil
+	return packetSequence, Buffer{Buf: decryptedBuff}, nil
 }
 
 // Reads and verifies the sequence id
@@ -567,8 +682,7 @@ func validateSequence(packetLen int, prefixByte uint8, sequence uint64, readPack
 	// replay protection (optional)
 	if replayProtection != nil && PacketType(packetType) >= ConnectionKeepAlive {
 		if replayProtection.AlreadyReceived(sequence) == 1 {
-			v := strconv.FormatUint(sequence, 10)
-			return errors.New("ignored connection payload packet. sequence " + v + " already received (replay protection)")
+			return &replayError{sequence}
 		}
 	}
 	return nil
@@ -594,14 +708,17 @@ func writePacketPrefix(p Packet, buffer *Buffer, sequence uint64) (uint8, error)
 	return prefixByte, nil
 }
 
-// Encrypts the packet data of the supplied buffer between encryptedStart and encrypedFinish.
-func encryptPacket(buffer *Buffer, encryptedStart, encryptedFinish int, prefixByte uint8, protocolId, sequence uint64, writePacketKey []byte) (int, error) {
+// Encrypts the packet data of the supplied buffer between encryptedStart and encrypedFinish. crypto is the session's
+// cached cipher, or nil to create one for this packet.
+func encryptPacket(buffer *Buffer, encryptedStart, encryptedFinish int, prefixByte uint8, protocolId, sequence uint64, writePacketKey []byte, crypto *packetCrypto) (int, error) {
 	// slice up the buffer for the bits we will encrypt
 	encryptedBuffer := buffer.Buf[encryptedStart:encryptedFinish]
 
-	additionalData, nonce := packetCryptData(prefixByte, protocolId, sequence)
+	if crypto == nil {
+		crypto = &packetCrypto{}
+	}
 
-	if err := EncryptAead(encryptedBuffer, additionalData, nonce, writePacketKey); err != nil {
+	if err := crypto.seal(encryptedBuffer, prefixByte, protocolId, sequence, writePacketKey); err != nil {
 		return -1, err
 	}
 
@@ -609,19 +726,6 @@ func encryptPacket(buffer *Buffer, encryptedStart, encryptedFinish int, prefixBy
 	return buffer.Pos, nil
 }
 
-// used for encrypting the per-packet packet written with the prefix byte, protocol id and version as the associated data. this must match to decrypt.
-func packetCryptData(prefixByte uint8, protocolId, sequence uint64) ([]byte, []byte) {
-	additionalData := NewBuffer(VERSION_INFO_BYTES + 8 + 1)
-	additionalData.WriteBytesN([]byte(VERSION_INFO), VERSION_INFO_BYTES)
-	additionalData.WriteUint64(protocolId)
-	additionalData.WriteUint8(prefixByte)
-
-	nonce := NewBuffer(SizeUint64 + SizeUint32)
-	nonce.WriteUint32(0)
-	nonce.WriteUint64(sequence)
-	return additionalData.Buf, nonce.Buf
-}
-
 // Depending on size of sequence number, we need to reserve N bytes
 func sequenceNumberBytesRequired(sequence uint64) uint8 {
 	var mask uint64
@@ -16,10 +16,16 @@ func NewPacketQueue(queueSize int) *PacketQueue {
 	return q
 }
 
+// Empties the queue, pooled packets still queued are released.
 func (q *PacketQueue) Clear() {
+	for i := range q.packets {
+		if q.packets[i] != nil {
+			releasePacket(q.packets[i])
+			q.packets[i] = nil
+		}
+	}
 	q.numPackets = 0
 	q.startIndex = 0
-	q.packets = make([]Packet, q.queueSize)
 }
 
 func (q *PacketQueue) Push(packet Packet) int {
@@ -39,6 +45,7 @@ func (q *PacketQueue) Pop() Packet {
 	}
 
 	packet := q.packets[q.startIndex]
+	q.packets[q.startIndex] = nil
 	q.startIndex = (q.startIndex + 1) % q.queueSize
 	q.numPackets--
 	return packet
@@ -0,0 +1,81 @@
+package netcode
+
+import (
+	"sync"
+)
+
+// Pools for the buffers and packets needed for each datagram, so a steady stream of
+// keep-alives and payloads does not allocate. Connection handshake packets may keep
+// references to the datagram they were read from so are left to the garbage collector.
+// The vendored ChaCha20-Poly1305 still allocates once per packet encrypted or decrypted when
+// built without its assembly, such as with the appengine tag or on other architectures.
+
+var netcodeDataPool = sync.Pool{
+	New: func() interface{} {
+		return &NetcodeData{buffer: make([]byte, MAX_PACKET_BYTES)}
+	},
+}
+
+var payloadPacketPool = sync.Pool{
+	New: func() interface{} {
+		return &PayloadPacket{PayloadData: make([]byte, 0, MAX_PAYLOAD_BYTES), pooled: true}
+	},
+}
+
+var keepAlivePacketPool = sync.Pool{
+	New: func() interface{} {
+		return &KeepAlivePacket{}
+	},
+}
+
+var disconnectPacketPool = sync.Pool{
+	New: func() interface{} {
+		return &DisconnectPacket{}
+	},
+}
+
+// returns a NetcodeData with a MAX_PACKET_BYTES buffer to read a datagram into.
+func acquireNetcodeData() *NetcodeData {
+	netData := netcodeDataPool.Get().(*NetcodeData)
+	netData.data = netData.buffer
+	return netData
+}
+
+// returns the NetcodeData to the pool once its packet has been processed.
+func (d *NetcodeData) release() {
+	if d.buffer == nil || (len(d.data) > 0 && PacketType(0).Peek(d.data) < ConnectionKeepAlive) {
+		return
+	}
+	d.data = nil
+	d.from = nil
+	d.conn = nil
+	netcodeDataPool.Put(d)
+}
+
+// Like NewPacket but returns keep-alive, payload and disconnect packets from a pool. They
+// are returned with releasePacket, or PayloadPacket.Release once handed to the application.
+func newPooledPacket(packetBuffer []byte) Packet {
+	switch PacketType(0).Peek(packetBuffer) {
+	case ConnectionKeepAlive:
+		return keepAlivePacketPool.Get().(*KeepAlivePacket)
+	case ConnectionPayload:
+		return payloadPacketPool.Get().(*PayloadPacket)
+	case ConnectionDisconnect:
+		return disconnectPacketPool.Get().(*DisconnectPacket)
+	}
+	return NewPacket(packetBuffer)
+}
+
+// returns a packet from newPooledPacket to its pool, other packets are ignored.
+func releasePacket(packet Packet) {
+	switch p := packet.(type) {
+	case *KeepAlivePacket:
+		*p = KeepAlivePacket{}
+		keepAlivePacketPool.Put(p)
+	case *PayloadPacket:
+		p.Release()
+	case *DisconnectPacket:
+		*p = DisconnectPacket{}
+		disconnectPacketPool.Put(p)
+	}
+}
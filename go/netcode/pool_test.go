@@ -0,0 +1,188 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPooledPacketRelease(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		releasePacket(newPooledPacket([]byte{byte(ConnectionKeepAlive)}))
+		releasePacket(newPooledPacket([]byte{byte(ConnectionPayload)}))
+	})
+	if allocs != 0 && !raceEnabled {
+		t.Fatalf("expected pooled packets not to allocate got %v allocs per packet\n", allocs)
+	}
+
+	// packets not taken from the pool are never returned to it
+	(&PayloadPacket{}).Release()
+	releasePacket(&KeepAlivePacket{})
+	releasePacket(&RequestPacket{})
+
+	handshake := acquireNetcodeData()
+	handshake.data[0] = byte(ConnectionChallenge)
+	handshake.release()
+	if handshake.data == nil {
+		t.Fatalf("expected handshake datagram to be left to the garbage collector\n")
+	}
+}
+
+func TestServerRecvPayloadAllocs(t *testing.T) {
+	serv, client := testConnectedServer(t)
+	defer serv.Stop()
+	defer client.Close()
+
+	instance := serv.clientManager.instances[0]
+	packetData := testWritePayloadPacket(client, t)
+	received := 0
+	allocs := testing.AllocsPerRun(100, func() {
+		// stands in for a datagram read from the socket
+		netData := acquireNetcodeData()
+		netData.data = netData.buffer[:copy(netData.buffer, packetData)]
+		instance.replayProtection.Reset()
+
+		serv.onPacketData(netData.data, instance.address, instance.serverConn)
+		netData.release()
+
+		if packet := serv.RecvPayloadPacket(0); packet != nil {
+			received++
+			packet.Release()
+		}
+	})
+
+	if received == 0 {
+		t.Fatalf("expected payloads to be queued\n")
+	}
+
+	// the portable AEAD allocates its MAC input, the assembly AEAD does not
+	if openAllocs := testCipherAllocs(t).open; allocs > openAllocs && !raceEnabled {
+		t.Fatalf("expected receiving a payload to allocate no more than decrypting it (%v) got %v allocs\n", openAllocs, allocs)
+	}
+}
+
+func TestServerSendPayloadsAllocs(t *testing.T) {
+	serv, client := testConnectedServer(t)
+	defer serv.Stop()
+	defer client.Close()
+
+	// unconfirmed clients are sent a keep-alive with every payload
+	serv.clientManager.instances[0].confirmed = true
+	payload := make([]byte, 256)
+	allocs := testing.AllocsPerRun(100, func() {
+		serv.SendPayloads(payload, serv.serverTime)
+	})
+
+	if sealAllocs := testCipherAllocs(t).seal; allocs > sealAllocs && !raceEnabled {
+		t.Fatalf("expected sending a payload to allocate no more than encrypting it (%v) got %v allocs\n", sealAllocs, allocs)
+	}
+}
+
+func BenchmarkServerRecvPayload(b *testing.B) {
+	serv, client := testConnectedServer(b)
+	defer serv.Stop()
+	defer client.Close()
+
+	instance := serv.clientManager.instances[0]
+	packetData := testWritePayloadPacket(client, b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		netData := acquireNetcodeData()
+		netData.data = netData.buffer[:copy(netData.buffer, packetData)]
+		instance.replayProtection.Reset()
+
+		serv.onPacketData(netData.data, instance.address, instance.serverConn)
+		netData.release()
+
+		packet := serv.RecvPayloadPacket(0)
+		if packet == nil {
+			b.Fatalf("expected payload to be queued\n")
+		}
+		packet.Release()
+	}
+}
+
+func BenchmarkServerSendPayload(b *testing.B) {
+	serv, client := testConnectedServer(b)
+	defer serv.Stop()
+	defer client.Close()
+
+	payload := make([]byte, 256)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		serv.SendPayloads(payload, serv.serverTime)
+	}
+}
+
+type testCipherAllocCounts struct {
+	seal float64
+	open float64
+}
+
+// returns the allocations of encrypting and decrypting a 256 byte payload, which depend on
+// whether the vendored AEAD was built with its assembly.
+func testCipherAllocs(t testing.TB) testCipherAllocCounts {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	var crypto packetCrypto
+	message := make([]byte, 256+MAC_BYTES)
+	var counts testCipherAllocCounts
+	counts.seal = testing.AllocsPerRun(100, func() {
+		crypto.seal(message[:256], uint8(ConnectionPayload), TEST_PROTOCOL_ID, 1, key)
+	})
+
+	// a failed open does the same work before it compares the MAC
+	counts.open = testing.AllocsPerRun(100, func() {
+		crypto.open(message, uint8(ConnectionPayload), TEST_PROTOCOL_ID, 1, key)
+	})
+	return counts
+}
+
+// returns a 256 byte payload packet as sent by the client.
+func testWritePayloadPacket(client *Client, t testing.TB) []byte {
+	packetData := make([]byte, MAX_PACKET_BYTES)
+	packetBytes, err := NewPayloadPacket(make([]byte, 256)).Write(packetData, TEST_PROTOCOL_ID, 1<<32, client.context.WritePacketKey)
+	if err != nil {
+		t.Fatalf("error writing payload packet: %s\n", err)
+	}
+	return packetData[:packetBytes]
+}
+
+// returns a server on an ephemeral port with a single connected client.
+func testConnectedServer(t testing.TB) (*Server, *Client) {
+	serv := NewServer(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 0}, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 1)
+	serv.SetLogger(nil)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+
+	addr := *serv.serverConns[0].LocalAddr().(*net.UDPAddr)
+	client := NewClient(testGenerateConnectToken([]net.UDPAddr{addr}, TEST_PRIVATE_KEY, t))
+	client.SetLogger(nil)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+
+	clientTime := float64(0)
+	for i := 0; i < 200 && client.GetState() != StateConnected; i += 1 {
+		serv.Update(serv.serverTime + 0.01)
+		client.Update(clientTime)
+		time.Sleep(5 * time.Millisecond)
+		clientTime += 0.01
+	}
+
+	if client.GetState() != StateConnected {
+		t.Fatalf("client failed to connect got: %s\n", clientStateMap[client.GetState()])
+	}
+	return serv, client
+}
@@ -0,0 +1,71 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerPublicAddresses(t *testing.T) {
+	serv := NewServer(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	if !serv.isPublicAddress(&net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}) || serv.isPublicAddress(&net.UDPAddr{IP: net.ParseIP("::2"), Port: 40000}) {
+		t.Fatalf("expected only the bind address to match without public addresses\n")
+	}
+
+	serv = NewServer(&net.UDPAddr{IP: net.IPv4zero, Port: 40000}, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	for _, addr := range []string{"203.0.113.1", "0.0.0.0"} {
+		if serv.isPublicAddress(&net.UDPAddr{IP: net.ParseIP(addr), Port: 40000}) {
+			t.Fatalf("expected %s not to match an unspecified bind address\n", addr)
+		}
+	}
+
+	if err := serv.Init(); err == nil {
+		t.Fatalf("expected error initializing server bound to an unspecified address without public addresses\n")
+	}
+
+	serv.SetPublicAddresses([]net.UDPAddr{
+		{IP: net.ParseIP("203.0.113.1"), Port: 50000},
+		{IP: net.ParseIP("2001:db8::1"), Port: 50000},
+	})
+
+	if serv.isPublicAddress(&net.UDPAddr{IP: net.ParseIP("203.0.113.2"), Port: 40000}) {
+		t.Fatalf("expected bind port to be ignored once public addresses are set\n")
+	}
+
+	for _, addr := range []string{"203.0.113.1", "::ffff:203.0.113.1", "2001:db8::1"} {
+		if !serv.isPublicAddress(&net.UDPAddr{IP: net.ParseIP(addr), Port: 50000}) {
+			t.Fatalf("expected %s to match the public addresses\n", addr)
+		}
+	}
+}
+
+func TestServerBindUnspecified(t *testing.T) {
+	serv := NewServer(&net.UDPAddr{IP: net.IPv6unspecified, Port: 40007}, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.SetPublicAddresses([]net.UDPAddr{{IP: net.ParseIP("::1"), Port: 40007}})
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	client := NewClient(testGenerateConnectToken([]net.UDPAddr{{IP: net.ParseIP("::1"), Port: 40007}}, TEST_PRIVATE_KEY, t))
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	defer client.Close()
+
+	clientTime := float64(0)
+	for i := 0; i < 200 && client.GetState() > StateDisconnected && client.GetState() != StateConnected; i += 1 {
+		client.Update(clientTime)
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+		serv.Update(serv.serverTime + 0.01)
+	}
+
+	if client.GetState() != StateConnected {
+		t.Fatalf("expected client to connect to server bound to [::] got: %s\n", clientStateMap[client.GetState()])
+	}
+}
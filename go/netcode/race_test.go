@@ -0,0 +1,7 @@
+//go:build race
+// +build race
+
+package netcode
+
+// sync.Pool randomly drops items under the race detector so allocation counts are not exact.
+const raceEnabled = true
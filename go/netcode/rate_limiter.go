@@ -0,0 +1,186 @@
+package netcode
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const RATE_LIMIT_MAX_ENTRIES = 65536               // max number of per address and per subnet buckets tracked
+const RATE_LIMIT_SWEEP_INTERVAL = 10 * time.Second // how often idle buckets are removed
+
+// Token bucket limits applied by the server's NetcodeConn to unauthenticated packets
+// (connection requests and responses) before any decryption is attempted. A rate of
+// 0 disables that limit.
+type RateLimitConfig struct {
+	AddressRate  float64 // packets per second allowed from a single source IP
+	AddressBurst float64 // packets a single source IP may send at once
+	SubnetRate   float64 // packets per second allowed from a single source subnet
+	SubnetBurst  float64 // packets a single source subnet may send at once
+	SubnetBitsV4 int     // prefix length used to group IPv4 sources into subnets
+	SubnetBitsV6 int     // prefix length used to group IPv6 sources into subnets
+	GlobalRate   float64 // packets per second allowed across all sources
+	GlobalBurst  float64 // packets all sources may send at once
+}
+
+// Returns limits which comfortably allow clients sending at PACKET_SEND_RATE. The subnet limit
+// groups IPv4 sources by /24 and IPv6 by /64, so servers with many players behind one NAT or
+// carrier-grade NAT range should raise SubnetRate and SubnetBurst or set SubnetRate to 0.
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		AddressRate:  PACKET_SEND_RATE * 2,
+		AddressBurst: PACKET_SEND_RATE * 4,
+		SubnetRate:   PACKET_SEND_RATE * 20,
+		SubnetBurst:  PACKET_SEND_RATE * 40,
+		SubnetBitsV4: 24,
+		SubnetBitsV6: 64,
+		GlobalRate:   PACKET_SEND_RATE * 500,
+		GlobalBurst:  PACKET_SEND_RATE * 1000,
+	}
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refills the bucket for the time elapsed since it was last used and takes a token if available.
+func (b *tokenBucket) allow(now time.Time, rate, burst float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens -= 1
+	return true
+}
+
+// returns true if the bucket would be full by now and can be dropped.
+func (b *tokenBucket) idle(now time.Time, rate, burst float64) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*rate >= burst
+}
+
+type rateLimiter struct {
+	mutex     sync.Mutex
+	config    RateLimitConfig
+	global    *tokenBucket
+	addresses map[[16]byte]*tokenBucket
+	subnets   map[[16]byte]*tokenBucket
+	lastSweep time.Time
+	stats     *ServerStats
+	clock     Clock
+}
+
+func newRateLimiter(config RateLimitConfig, stats *ServerStats, clock Clock) *rateLimiter {
+	r := &rateLimiter{stats: stats, clock: clock}
+	r.setConfig(config)
+	return r
+}
+
+// replaces the config and resets all buckets, safe to call while packets are being read.
+func (r *rateLimiter) setConfig(config RateLimitConfig) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reset(config)
+}
+
+// replaces the clock and resets all buckets as their times were read from the old clock.
+func (r *rateLimiter) setClock(clock Clock) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.clock = clock
+	r.reset(r.config)
+}
+
+func (r *rateLimiter) reset(config RateLimitConfig) {
+	now := r.clock.Now()
+	r.config = config
+	r.global = &tokenBucket{tokens: config.GlobalBurst, last: now}
+	r.addresses = make(map[[16]byte]*tokenBucket)
+	r.subnets = make(map[[16]byte]*tokenBucket)
+	r.lastSweep = now
+}
+
+// returns true if the packet should be processed. Only connection requests and responses
+// are limited as every other packet type is dropped by the server unless it comes from a
+// known address.
+func (r *rateLimiter) allow(packetType PacketType, addr *net.UDPAddr) bool {
+	if packetType != ConnectionRequest && packetType != ConnectionResponse {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.clock.Now()
+	if now.Sub(r.lastSweep) >= RATE_LIMIT_SWEEP_INTERVAL {
+		r.sweep(now)
+	}
+
+	config := &r.config
+	if config.AddressRate > 0 && !r.allowKey(r.addresses, addressKey(addr.IP), now, config.AddressRate, config.AddressBurst) {
+		r.stats.addRateLimited()
+		return false
+	}
+
+	if config.SubnetRate > 0 && !r.allowKey(r.subnets, subnetKey(addr.IP, config.SubnetBitsV4, config.SubnetBitsV6), now, config.SubnetRate, config.SubnetBurst) {
+		r.stats.addRateLimited()
+		return false
+	}
+
+	if config.GlobalRate > 0 && !r.global.allow(now, config.GlobalRate, config.GlobalBurst) {
+		r.stats.addRateLimited()
+		return false
+	}
+	return true
+}
+
+// once the table is full new sources are only subject to the remaining limits, this
+// bounds memory when flooded from many spoofed addresses.
+func (r *rateLimiter) allowKey(buckets map[[16]byte]*tokenBucket, key [16]byte, now time.Time, rate, burst float64) bool {
+	bucket, ok := buckets[key]
+	if !ok {
+		if len(buckets) >= RATE_LIMIT_MAX_ENTRIES {
+			return true
+		}
+		bucket = &tokenBucket{tokens: burst, last: now}
+		buckets[key] = bucket
+	}
+	return bucket.allow(now, rate, burst)
+}
+
+// removes buckets which have refilled, they behave the same as a new bucket.
+func (r *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range r.addresses {
+		if bucket.idle(now, r.config.AddressRate, r.config.AddressBurst) {
+			delete(r.addresses, key)
+		}
+	}
+
+	for key, bucket := range r.subnets {
+		if bucket.idle(now, r.config.SubnetRate, r.config.SubnetBurst) {
+			delete(r.subnets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+func addressKey(ip net.IP) [16]byte {
+	var key [16]byte
+	copy(key[:], ip.To16())
+	return key
+}
+
+func subnetKey(ip net.IP, bitsV4, bitsV6 int) [16]byte {
+	var key [16]byte
+	if ip4 := ip.To4(); ip4 != nil {
+		copy(key[:], ip4.Mask(net.CIDRMask(bitsV4, 32)).To16())
+		return key
+	}
+	copy(key[:], ip.To16().Mask(net.CIDRMask(bitsV6, 128)))
+	return key
+}
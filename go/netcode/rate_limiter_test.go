@@ -0,0 +1,99 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	stats := &ServerStats{}
+	config := RateLimitConfig{AddressRate: 1, AddressBurst: 2, SubnetRate: 1, SubnetBurst: 3, SubnetBitsV4: 24, SubnetBitsV6: 64}
+	clock := NewManualClock(time.Unix(1000, 0))
+	limiter := newRateLimiter(config, stats, clock)
+
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	for i := 0; i < 2; i += 1 {
+		if !limiter.allow(ConnectionRequest, addr) {
+			t.Fatalf("request %d should be allowed within the address burst\n", i)
+		}
+	}
+
+	if limiter.allow(ConnectionResponse, addr) {
+		t.Fatalf("response should be limited once the address burst is used\n")
+	}
+
+	if !limiter.allow(ConnectionKeepAlive, addr) || !limiter.allow(ConnectionPayload, addr) {
+		t.Fatalf("authenticated packet types should never be limited\n")
+	}
+
+	// same /24, address bucket is new but the subnet only has one token left
+	neighbour := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 40000}
+	if !limiter.allow(ConnectionRequest, neighbour) {
+		t.Fatalf("request from neighbour should be allowed within the subnet burst\n")
+	}
+
+	if limiter.allow(ConnectionRequest, neighbour) {
+		t.Fatalf("request from neighbour should be limited once the subnet burst is used\n")
+	}
+
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.1.1"), Port: 40000}
+	if !limiter.allow(ConnectionRequest, other) {
+		t.Fatalf("request from another subnet should be allowed\n")
+	}
+
+	if stats.RateLimited != 2 {
+		t.Fatalf("expected 2 rate limited packets got %d\n", stats.RateLimited)
+	}
+
+	limiter.setConfig(RateLimitConfig{GlobalRate: 1, GlobalBurst: 1})
+	if !limiter.allow(ConnectionRequest, addr) {
+		t.Fatalf("request should be allowed after config change\n")
+	}
+
+	if limiter.allow(ConnectionRequest, other) {
+		t.Fatalf("request should be limited once the global burst is used\n")
+	}
+
+	clock.Advance(time.Second)
+	if !limiter.allow(ConnectionRequest, other) {
+		t.Fatalf("request should be allowed once the global bucket has refilled\n")
+	}
+}
+
+func TestSubnetKey(t *testing.T) {
+	a := subnetKey(net.ParseIP("2001:db8::1"), 24, 64)
+	b := subnetKey(net.ParseIP("2001:db8::ffff:1"), 24, 64)
+	c := subnetKey(net.ParseIP("2001:db8:0:1::1"), 24, 64)
+	if a != b {
+		t.Fatalf("expected addresses in the same /64 to share a key\n")
+	}
+
+	if a == c {
+		t.Fatalf("expected addresses in different /64s to have different keys\n")
+	}
+
+	if subnetKey(net.ParseIP("192.168.1.1"), 24, 64) != subnetKey(net.ParseIP("192.168.1.200").To16(), 24, 64) {
+		t.Fatalf("expected ipv4 addresses in the same /24 to share a key\n")
+	}
+}
+
+func TestServerRateLimitOptIn(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	serv := NewServer(addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	for i := 0; i < 1000; i += 1 {
+		if !serv.rateLimiter.allow(ConnectionRequest, addr) {
+			t.Fatalf("requests should not be limited unless a rate limit is set\n")
+		}
+	}
+
+	serv.SetRateLimit(DefaultRateLimitConfig())
+	limited := false
+	for i := 0; i < 1000 && !limited; i += 1 {
+		limited = !serv.rateLimiter.allow(ConnectionRequest, addr)
+	}
+
+	if !limited {
+		t.Fatalf("requests should be limited once a rate limit is set\n")
+	}
+}
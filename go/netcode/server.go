@@ -2,7 +2,6 @@ package netcode
 
 import (
 	"errors"
-	"log"
 	"net"
 	"sync/atomic"
 	"time"
@@ -12,8 +11,13 @@ const TIMEOUT_SECONDS = 5 // default timeout for clients
 const MAX_SERVER_PACKETS = 64
 
 type Server struct {
-	serverConn       *NetcodeConn
-	serverAddr       *net.UDPAddr
+	serverConns      []*NetcodeConn
+	serverAddrs      []*net.UDPAddr // listen addresses, the address passed to NewServer first
+	publicAddrs      []net.UDPAddr  // addresses accepted in the connect token whitelist, defaults to serverAddrs
+	recvConn         *NetcodeConn   // socket the packet being processed arrived on, replies are sent on it
+	readSockets      int            // sockets bound to each listen address
+	batchSize        int            // packets read or written per system call, 0 disables batching
+	transport        Transport      // used instead of UDP sockets when set
 	shutdownCh       chan struct{}
 	serverTime       float64
 	running          bool
@@ -30,17 +34,41 @@ type Server struct {
 	protocolId      uint64
 
 	privateKey   []byte
+	keyRing      *KeyRing
 	challengeKey []byte
 
 	challengeSequence uint64
-
-	recvBytes int
-	packetCh  chan *NetcodeData
+	challenge         challengeKeys
+
+	recvBytes      int
+	packetCh       chan *NetcodeData
+	decryptWorkers int
+	decrypt        *decryptPipeline // set while listening with more than one decrypt worker
+	packetBuffer   []byte           // reused for packets sent before a client connects
+	logger         Logger
+	stats          *ServerStats
+	rateLimiter    *rateLimiter
+	clock          Clock
+
+	accessList         *AccessList
+	accessListVersion  uint64 // version of the access list connected clients were last checked against
+	admissionHandlerFn AdmissionHandler
+
+	draining int32 // set atomically once Drain is called
+	drainCh  chan *drainRequest
+	drain    *drainRequest // in progress drain, only accessed from Update
+
+	tickRate  float64
+	runState  int32 // 0 not run, 1 running, 2 finished
+	payloadCh chan *ServerPayload
+	eventCh   chan *ServerEvent
+	commandCh chan *serverCommand
 }
 
 func NewServer(serverAddress *net.UDPAddr, privateKey []byte, protocolId uint64, maxClients int) *Server {
 	s := &Server{}
-	s.serverAddr = serverAddress
+	s.serverAddrs = []*net.UDPAddr{serverAddress}
+	s.readSockets = 1
 	s.protocolId = protocolId
 	s.privateKey = privateKey
 	s.maxClients = maxClients
@@ -48,8 +76,20 @@ func NewServer(serverAddress *net.UDPAddr, privateKey []byte, protocolId uint64,
 	s.globalSequence = uint64(1) << 63
 	s.timeout = float64(TIMEOUT_SECONDS)
 	s.clientManager = NewClientManager(s.timeout, maxClients)
+	s.stats = s.clientManager.stats
+	s.clock = systemClock{}
+	s.rateLimiter = newRateLimiter(RateLimitConfig{}, s.stats, s.clock)
 	s.packetCh = make(chan *NetcodeData, s.maxClients*MAX_SERVER_PACKETS*2)
+	s.packetBuffer = make([]byte, MAX_PACKET_BYTES)
 	s.shutdownCh = make(chan struct{})
+	s.challenge.rotateTime = -1
+	s.drainCh = make(chan *drainRequest, 1)
+	s.logger = NewLogger(LogLevelInfo)
+
+	s.tickRate = DEFAULT_TICK_RATE
+	s.payloadCh = make(chan *ServerPayload, s.maxClients*MAX_SERVER_PACKETS)
+	s.eventCh = make(chan *ServerEvent, s.maxClients*4)
+	s.commandCh = make(chan *serverCommand, s.maxClients*MAX_SERVER_PACKETS)
 
 	// set allowed packets for this server
 	s.allowedPackets = make([]byte, ConnectionNumPackets)
@@ -65,11 +105,119 @@ func (s *Server) SetAllowedPackets(allowedPackets []byte) {
 	s.allowedPackets = allowedPackets
 }
 
+// Adds another address for the server to listen on, such as an IPv4 address alongside the
+// IPv6 address passed to NewServer. Every socket shares the same clients, and each client is
+// replied to on the socket it connected through. Must be called before Init.
+func (s *Server) AddListenAddress(addr *net.UDPAddr) {
+	s.serverAddrs = append(s.serverAddrs, addr)
+}
+
+// Sets the number of sockets bound to each listen address, each read by its own goroutine. Above
+// 1 the sockets are bound with SO_REUSEPORT so the kernel hashes each client to a single socket,
+// keeping their packets in order. Only supported on Linux. Must be called before Init.
+func (s *Server) SetReadSockets(count int) error {
+	if count < 1 {
+		return errors.New("read socket count must be at least 1")
+	}
+
+	if count > 1 && !reusePortSupported {
+		return errors.New("multiple read sockets require SO_REUSEPORT which is not supported on this platform")
+	}
+	s.readSockets = count
+	return nil
+}
+
+// Sets the number of packets read and written per system call, 0 or 1 disables batching.
+// Keep-alives and payloads sent to every client are written in batches. Batches use
+// recvmmsg and sendmmsg on Linux. Must be called before Init.
+func (s *Server) SetBatchSize(size int) {
+	s.batchSize = size
+}
+
+// Sets the transport the server reads and writes packets on instead of binding UDP sockets, such
+// as a MemoryTransport or a relay socket. The address passed to NewServer is still the address
+// connect tokens must contain. The server closes the transport when stopped. AddListenAddress
+// and SetReadSockets have no effect. Must be called before Init.
+func (s *Server) SetTransport(transport Transport) {
+	s.transport = transport
+}
+
+// Sets the addresses clients are given in their connect tokens when they differ from the
+// address passed to NewServer, for example when running behind NAT or a load balancer. Servers
+// bound to an unspecified address such as [::] must set them before Init. Include every form the
+// token issuer may use, such as both the IPv4 and IPv6 address of the host. Must be called from
+// the same goroutine as Update.
+func (s *Server) SetPublicAddresses(addrs []net.UDPAddr) {
+	s.publicAddrs = make([]net.UDPAddr, len(addrs))
+	copy(s.publicAddrs, addrs)
+}
+
+// Returns true if the connect token whitelist address refers to this server. Without public
+// addresses a listen address must match exactly, an unspecified address never matches.
+func (s *Server) isPublicAddress(tokenAddr *net.UDPAddr) bool {
+	if len(s.publicAddrs) > 0 {
+		for i := range s.publicAddrs {
+			if addressEqual(&s.publicAddrs[i], tokenAddr) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, serverAddr := range s.serverAddrs {
+		if !isUnspecifiedAddress(serverAddr) && addressEqual(serverAddr, tokenAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+func isUnspecifiedAddress(addr *net.UDPAddr) bool {
+	return addr.IP == nil || addr.IP.IsUnspecified()
+}
+
 func (s *Server) SetTimeout(duration time.Duration) {
 	s.timeout = duration.Seconds()
 	s.clientManager.setTimeout(s.timeout)
 }
 
+// Sets the logger used by the server, its client slots and connection. A nil logger disables logging.
+func (s *Server) SetLogger(logger Logger) {
+	s.logger = loggerOrNone(logger)
+	s.clientManager.setLogger(s.logger)
+	for _, conn := range s.serverConns {
+		conn.SetLogger(s.logger)
+	}
+}
+
+// Sets the handler called when clients connect, are confirmed, time out, disconnect or are kicked.
+func (s *Server) SetEventHandler(eventHandlerFn ServerEventHandler) {
+	s.clientManager.setEventHandler(eventHandlerFn)
+}
+
+// Sets the limits applied to connection requests and responses before they are decrypted.
+// Rate limiting is off unless set, DefaultRateLimitConfig is a starting point. May be called
+// at any time, the zero RateLimitConfig turns it off again.
+func (s *Server) SetRateLimit(config RateLimitConfig) {
+	s.rateLimiter.setConfig(config)
+}
+
+// Sets the clock connect token expiry, rate limits and key ring activation are checked against,
+// nil reverts to the system clock. Must be called before Listen.
+func (s *Server) SetClock(clock Clock) {
+	s.clock = clockOrSystem(clock)
+	s.rateLimiter.setClock(s.clock)
+}
+
+// Sets the ban list checked for connection requests and connected clients, nil disables it.
+// Connected clients are checked against the list on the next Update.
+func (s *Server) SetAccessList(accessList *AccessList) {
+	s.accessList = accessList
+	if accessList != nil {
+		s.accessListVersion = accessList.getVersion() - 1
+	}
+}
+
 func (s *Server) SetIgnoreRequests(val bool) {
 	s.ignoreRequests = val
 }
@@ -92,26 +240,92 @@ func (s *Server) incGlobalSequence() uint64 {
 func (s *Server) Init() error {
 	var err error
 
+	// tokens name the address clients connect to, which an unspecified address does not give
+	if len(s.publicAddrs) == 0 {
+		for _, addr := range s.serverAddrs {
+			if isUnspecifiedAddress(addr) {
+				return errors.New("server bound to an unspecified address requires public addresses")
+			}
+		}
+	}
+
 	s.challengeKey, err = GenerateKey()
 	if err != nil {
 		return err
 	}
-	s.serverConn = NewNetcodeConn()
-	s.serverConn.SetReadBuffer(SOCKET_RCVBUF_SIZE * s.maxClients)
-	s.serverConn.SetWriteBuffer(SOCKET_SNDBUF_SIZE * s.maxClients)
-	s.serverConn.SetRecvHandler(s.handleNetcodeData)
+
+	// sockets for the same address are stored next to each other
+	numConns := len(s.serverAddrs) * s.readSockets
+	if s.transport != nil {
+		numConns = 1
+	}
+
+	s.serverConns = make([]*NetcodeConn, numConns)
+	for i := range s.serverConns {
+		conn := NewNetcodeConn()
+		conn.SetLogger(s.logger)
+		conn.SetReadBuffer(SOCKET_RCVBUF_SIZE * s.maxClients / s.readSockets)
+		conn.SetWriteBuffer(SOCKET_SNDBUF_SIZE * s.maxClients / s.readSockets)
+		conn.SetRecvHandler(s.handleNetcodeData)
+		conn.setRateLimiter(s.rateLimiter)
+		conn.reusePort = s.readSockets > 1
+		conn.SetBatchSize(s.batchSize)
+		if s.transport != nil {
+			conn.SetTransport(s.transport)
+		}
+		s.serverConns[i] = conn
+	}
 	return nil
 }
 
 func (s *Server) Listen() error {
 	s.running = true
 
-	if err := s.serverConn.Listen(s.serverAddr); err != nil {
-		return err
+	var addr *net.UDPAddr
+	for i, conn := range s.serverConns {
+		if i%s.readSockets == 0 {
+			addr = s.serverAddrs[i/s.readSockets]
+		}
+
+		network := addr.Network()
+		if len(s.serverAddrs) > 1 {
+			network = listenNetwork(addr)
+		}
+
+		if err := conn.listen(network, addr); err != nil {
+			for _, opened := range s.serverConns[:i] {
+				opened.Close()
+			}
+			return err
+		}
+
+		// the remaining sockets must share the port the system picked, which connect tokens use
+		if localAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.Port == 0 {
+			addr = &net.UDPAddr{IP: addr.IP, Port: localAddr.Port, Zone: addr.Zone}
+			s.serverAddrs[i/s.readSockets] = addr
+		}
+	}
+
+	if s.decryptWorkers > 1 {
+		s.decrypt = newDecryptPipeline(s.decryptWorkers, cap(s.packetCh))
+		s.decrypt.start()
 	}
 	return nil
 }
 
+// returns the network restricted to the address family so an unspecified IPv6 address does not
+// also claim the IPv4 port when the server listens on both.
+func listenNetwork(addr *net.UDPAddr) string {
+	if addr.IP == nil {
+		return "udp"
+	}
+
+	if addr.IP.To4() != nil {
+		return "udp4"
+	}
+	return "udp6"
+}
+
 func (s *Server) SendPayloads(payloadData []byte, serverTime float64) {
 	if !s.running {
 		return
@@ -126,7 +340,7 @@ func (s *Server) SendPayloadToClient(clientId uint64, payloadData []byte, server
 		return err
 	}
 
-	s.clientManager.sendPayloadToInstance(clientIndex, payloadData, serverTime)
+	s.clientManager.sendPayloadToInstance(clientIndex, payloadData, serverTime, false)
 	return nil
 }
 
@@ -137,18 +351,27 @@ func (s *Server) Update(time float64) error {
 
 	s.serverTime = time
 
+	if s.decrypt != nil {
+		s.readPipelined()
+		goto DONE
+	}
+
 	// empty recv'd data from channel so we can have safe access to client manager data structures
 	for {
 		select {
 		case recv := <-s.packetCh:
-			s.OnPacketData(recv.data, recv.from)
+			s.onPacketData(recv.data, recv.from, recv.conn)
+			recv.release()
 		default:
 			goto DONE
 		}
 	}
 DONE:
+	s.checkChallengeKeyRotation()
+	s.kickBannedClients()
 	s.clientManager.SendKeepAlives(s.serverTime)
 	s.clientManager.CheckTimeouts(s.serverTime)
+	s.checkDrain()
 	return nil
 }
 
@@ -179,12 +402,32 @@ func (s *Server) getClientIndexByClientId(clientId uint64) (int, error) {
 // that the recv'd data is > 0 < maxBytes and is of a valid packet type before
 // this is even called.
 // NOTE: we will block the netcodeConn from processing which is what we want since
-// we want to synchronize access from the Update call.
+// we want to synchronize access from the Update call. Connection requests and responses
+// are dropped instead so a flood can not stall packets from connected clients.
 func (s *Server) handleNetcodeData(packetData *NetcodeData) {
-	s.packetCh <- packetData
+	packetType := PacketType(0).Peek(packetData.data)
+	if packetType != ConnectionRequest && packetType != ConnectionResponse {
+		s.packetCh <- packetData
+		return
+	}
+
+	select {
+	case s.packetCh <- packetData:
+	default:
+		s.stats.addBacklogDropped()
+	}
 }
 
+// Processes the packet as if it arrived on the first listen address.
 func (s *Server) OnPacketData(packetData []byte, addr *net.UDPAddr) {
+	var conn *NetcodeConn
+	if len(s.serverConns) > 0 {
+		conn = s.serverConns[0]
+	}
+	s.onPacketData(packetData, addr, conn)
+}
+
+func (s *Server) onPacketData(packetData []byte, addr *net.UDPAddr, conn *NetcodeConn) {
 	var readPacketKey []byte
 	var replayProtection *ReplayProtection
 
@@ -192,7 +435,9 @@ func (s *Server) OnPacketData(packetData []byte, addr *net.UDPAddr) {
 		return
 	}
 
+	s.recvConn = conn
 	size := len(packetData)
+	s.stats.addReceived(size)
 
 	encryptionIndex := -1
 	clientIndex := s.clientManager.FindClientIndexByAddress(addr)
@@ -203,20 +448,64 @@ func (s *Server) OnPacketData(packetData []byte, addr *net.UDPAddr) {
 	}
 	readPacketKey = s.clientManager.GetEncryptionEntryRecvKey(encryptionIndex)
 
-	timestamp := uint64(time.Now().Unix())
+	timestamp := uint64(s.clock.Now().Unix())
 
-	packet := NewPacket(packetData)
+	packet := newPooledPacket(packetData)
+	var clientStats *TrafficStats
 	if clientIndex != -1 {
 		client := s.clientManager.instances[clientIndex]
 		replayProtection = client.replayProtection
+		clientStats = client.stats
+		clientStats.addReceived(size)
+	}
+
+	var err error
+	if s.keyRing != nil && packet.GetType() == ConnectionRequest {
+		packet, err = s.readKeyRingRequest(packetData, size, timestamp)
+	} else {
+		readCrypto := s.clientManager.getEncryptionEntryCrypto(encryptionIndex, false)
+		err = readSessionPacket(packet, packetData, size, s.protocolId, timestamp, readPacketKey, s.privateKey, s.allowedPackets, replayProtection, readCrypto)
 	}
 
-	if err := packet.Read(packetData, size, s.protocolId, timestamp, readPacketKey, s.privateKey, s.allowedPackets, replayProtection); err != nil {
-		log.Printf("error reading packet: %s from %s\n", err, addr)
+	if err != nil {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server error reading packet", fieldAddress(addr), fieldError(err))
+		}
+		s.stats.addReadError(err)
+		if clientStats != nil {
+			clientStats.addReadError(err)
+		}
+		releasePacket(packet)
 		return
 	}
 
 	s.processPacket(clientIndex, encryptionIndex, packet, addr)
+
+	// payloads are owned by the client's packet queue
+	if packet.GetType() != ConnectionPayload {
+		releasePacket(packet)
+	}
+}
+
+// disconnects connected clients which have been banned since the access list was last checked.
+func (s *Server) kickBannedClients() {
+	if s.accessList == nil {
+		return
+	}
+
+	version := s.accessList.getVersion()
+	if version == s.accessListVersion {
+		return
+	}
+	s.accessListVersion = version
+
+	for _, client := range s.clientManager.instances {
+		if !client.connected || !s.accessList.IsBanned(client.clientId, client.address) {
+			continue
+		}
+		s.logger.Log(LogLevelInfo, "server kicked banned client", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex), fieldAddress(client.address))
+		s.clientManager.disconnectClient(client, true, s.serverTime, EventClientKicked)
+	}
 }
 
 func (s *Server) processPacket(clientIndex, encryptionIndex int, packet Packet, addr *net.UDPAddr) {
@@ -225,13 +514,17 @@ func (s *Server) processPacket(clientIndex, encryptionIndex int, packet Packet,
 		if s.ignoreRequests {
 			return
 		}
-		log.Printf("server received connection request from %s\n", addr.String())
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server received connection request", fieldAddress(addr))
+		}
 		s.processConnectionRequest(packet, addr)
 	case ConnectionResponse:
 		if s.ignoreResponses {
 			return
 		}
-		log.Printf("server received connection response from %s\n", addr.String())
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server received connection response", fieldAddress(addr))
+		}
 		s.processConnectionResponse(clientIndex, encryptionIndex, packet, addr)
 	case ConnectionKeepAlive:
 		if clientIndex == -1 {
@@ -242,10 +535,12 @@ func (s *Server) processPacket(clientIndex, encryptionIndex int, packet Packet,
 
 		if !client.confirmed {
 			client.confirmed = true
-			log.Printf("server confirmed connection to client %d:%s\n", client.clientId, client.address.String())
+			s.logger.Log(LogLevelInfo, "server confirmed connection to client", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex), fieldAddress(client.address))
+			s.clientManager.emitEvent(EventClientConfirmed, client)
 		}
 	case ConnectionPayload:
 		if clientIndex == -1 {
+			releasePacket(packet)
 			return
 		}
 		client := s.clientManager.instances[clientIndex]
@@ -253,17 +548,25 @@ func (s *Server) processPacket(clientIndex, encryptionIndex int, packet Packet,
 
 		if !client.confirmed {
 			client.confirmed = true
-			log.Printf("server confirmed connection to client %d:%s\n", client.clientId, client.address.String())
+			s.logger.Log(LogLevelInfo, "server confirmed connection to client", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex), fieldAddress(client.address))
+			s.clientManager.emitEvent(EventClientConfirmed, client)
 		}
 
-		client.packetQueue.Push(packet)
+		if client.packetQueue.Push(packet) == 0 {
+			if logEnabled(s.logger, LogLevelDebug) {
+				s.logger.Log(LogLevelDebug, "server dropped payload. client packet queue is full", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex))
+			}
+			s.stats.addQueueOverflow()
+			client.stats.addQueueOverflow()
+			releasePacket(packet)
+		}
 	case ConnectionDisconnect:
 		if clientIndex == -1 {
 			return
 		}
 		client := s.clientManager.instances[clientIndex]
-		log.Printf("server received disconnect packet from client %d:%s\n", client.clientId, client.address.String())
-		s.clientManager.disconnectClient(client, false, s.serverTime)
+		s.logger.Log(LogLevelInfo, "server received disconnect packet from client", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex), fieldAddress(client.address))
+		s.clientManager.disconnectClient(client, false, s.serverTime, EventClientDisconnected)
 	}
 }
 
@@ -274,47 +577,91 @@ func (s *Server) processConnectionRequest(packet Packet, addr *net.UDPAddr) {
 	}
 
 	if len(requestPacket.Token.ServerAddrs) == 0 {
-		log.Printf("server ignored connection request. server address not in connect token whitelist\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. server address not in connect token whitelist", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
 		return
 	}
 
 	addrFound := false
 	for _, tokenAddr := range requestPacket.Token.ServerAddrs {
-		if addressEqual(s.serverAddr, &tokenAddr) {
+		if s.isPublicAddress(&tokenAddr) {
 			addrFound = true
 			break
 		}
 	}
 
 	if !addrFound {
-		log.Printf("server ignored connection request. server address not in connect token whitelist\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. server address not in connect token whitelist", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
+	}
+
+	if s.IsDraining() {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server denied connection request. server is draining", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.sendDeniedPacket(requestPacket.Token.ServerKey, addr)
+		return
+	}
+
+	if s.accessList != nil && s.accessList.IsBanned(requestPacket.Token.ClientId, addr) {
+		s.logger.Log(LogLevelInfo, "server denied connection request. client is banned", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		s.sendDeniedPacket(requestPacket.Token.ServerKey, addr)
 		return
 	}
 
 	clientIndex := s.clientManager.FindClientIndexByAddress(addr)
 	if clientIndex != -1 {
-		log.Printf("server ignored connection request. a client with this address is already connected\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. a client with this address is already connected", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
 	}
 
 	clientIndex = s.clientManager.FindClientIndexById(requestPacket.Token.ClientId)
 	if clientIndex != -1 {
-		log.Printf("server ignored connection request. a client with this id has already been used\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. a client with this id has already been used", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
 	}
 
-	if !s.clientManager.FindOrAddTokenEntry(requestPacket.Token.Mac(), addr, s.serverTime) {
-		log.Printf("server ignored connection request. connect token has already been used\n")
+	// the token entry is kept until the connect token expires, converted from unix time to server time
+	tokenExpireTime := s.serverTime + float64(int64(requestPacket.ConnectTokenExpireTimestamp)-s.clock.Now().Unix())
+	if !s.clientManager.findOrAddTokenEntry(requestPacket.Token.Mac(), addr, s.serverTime, tokenExpireTime) {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. connect token has already been used", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
 	}
 
 	if s.clientManager.ConnectedClientCount() == s.maxClients {
-		log.Printf("server denied connection request. server is full\n")
+		s.logger.Log(LogLevelInfo, "server denied connection request. server is full", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
 		s.sendDeniedPacket(requestPacket.Token.ServerKey, addr)
 		return
 	}
 
+	admissionRequest := newAdmissionRequest(requestPacket.Token.ClientId, addr, requestPacket.Token.UserData, requestPacket.ConnectTokenSequence, false)
+	if !s.admit(admissionRequest, requestPacket.Token.ServerKey) {
+		return
+	}
+
 	if !s.clientManager.AddEncryptionMapping(requestPacket.Token, addr, s.serverTime, s.serverTime+s.timeout) {
-		log.Printf("server ignored connection request. failed to add encryption mapping\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection request. failed to add encryption mapping", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
 		return
 	}
+	encryptionIndex := s.clientManager.FindEncryptionEntryIndex(addr, s.serverTime)
+	s.clientManager.setEncryptionEntryTokenSequence(encryptionIndex, requestPacket.ConnectTokenSequence)
 
 	s.sendChallengePacket(requestPacket, addr)
 }
@@ -328,7 +675,8 @@ func (s *Server) sendChallengePacket(requestPacket *RequestPacket, addr *net.UDP
 	challengeSequence := s.incChallengeSequence()
 
 	if err := EncryptChallengeToken(challengeBuf, challengeSequence, s.challengeKey); err != nil {
-		log.Printf("server ignored connection request. failed to encrypt challenge token\n")
+		s.logger.Log(LogLevelError, "server ignored connection request. failed to encrypt challenge token", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr), fieldError(err))
+		s.stats.addIgnored()
 		return
 	}
 
@@ -336,19 +684,24 @@ func (s *Server) sendChallengePacket(requestPacket *RequestPacket, addr *net.UDP
 	challengePacket.ChallengeTokenData = challengeBuf
 	challengePacket.ChallengeTokenSequence = challengeSequence
 
-	buffer := make([]byte, MAX_PACKET_BYTES)
-	if bytesWritten, err = challengePacket.Write(buffer, s.protocolId, s.incGlobalSequence(), requestPacket.Token.ServerKey); err != nil {
-		log.Printf("server error while writing challenge packet\n")
+	if bytesWritten, err = challengePacket.Write(s.packetBuffer, s.protocolId, s.incGlobalSequence(), requestPacket.Token.ServerKey); err != nil {
+		s.logger.Log(LogLevelError, "server error while writing challenge packet", fieldClientId(requestPacket.Token.ClientId), fieldAddress(addr), fieldError(err))
 		return
 	}
 
-	s.sendGlobalPacket(buffer[:bytesWritten], addr)
+	s.sendGlobalPacket(s.packetBuffer[:bytesWritten], addr)
 }
 
 func (s *Server) sendGlobalPacket(packetBuffer []byte, addr *net.UDPAddr) {
-	if _, err := s.serverConn.WriteTo(packetBuffer, addr); err != nil {
-		log.Printf("error sending packet to %s\n", addr.String())
+	if s.recvConn == nil {
+		return
 	}
+
+	if _, err := s.recvConn.WriteTo(packetBuffer, addr); err != nil {
+		s.logger.Log(LogLevelError, "server error sending packet", fieldAddress(addr), fieldError(err))
+		return
+	}
+	s.stats.addSent(len(packetBuffer))
 }
 
 func (s *Server) processConnectionResponse(clientIndex, encryptionIndex int, packet Packet, addr *net.UDPAddr) {
@@ -361,35 +714,82 @@ func (s *Server) processConnectionResponse(clientIndex, encryptionIndex int, pac
 		return
 	}
 
-	if tokenBuffer, err = DecryptChallengeToken(responsePacket.ChallengeTokenData, responsePacket.ChallengeTokenSequence, s.challengeKey); err != nil {
-		log.Printf("failed to decrypt challenge token: %s\n", err)
+	challengeKey := s.challengeKeyForSequence(responsePacket.ChallengeTokenSequence)
+	if challengeKey == nil {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection response. challenge key has expired", fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
+	}
+
+	if tokenBuffer, err = DecryptChallengeToken(responsePacket.ChallengeTokenData, responsePacket.ChallengeTokenSequence, challengeKey); err != nil {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server failed to decrypt challenge token", fieldAddress(addr), fieldError(err))
+		}
+		s.stats.addIgnored()
 		return
 	}
 
 	if challengeToken, err = ReadChallengeToken(tokenBuffer); err != nil {
-		log.Printf("failed to read challenge token: %s\n", err)
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server failed to read challenge token", fieldAddress(addr), fieldError(err))
+		}
+		s.stats.addIgnored()
 		return
 	}
 
 	sendKey := s.clientManager.GetEncryptionEntrySendKey(encryptionIndex)
 	if sendKey == nil {
-		log.Printf("server ignored connection response. no packet send key\n")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection response. no packet send key", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
 	}
 
 	if s.clientManager.FindClientIndexByAddress(addr) != -1 {
-		log.Printf("server ignored connection response. a client with this address is already connected")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection response. a client with this address is already connected", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
 	}
 
 	if s.clientManager.FindClientIndexById(challengeToken.ClientId) != -1 {
-		log.Printf("server ignored connection response. a client with this id is already connected")
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server ignored connection response. a client with this id is already connected", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
+		}
+		s.stats.addIgnored()
+		return
+	}
+
+	if s.IsDraining() {
+		if logEnabled(s.logger, LogLevelDebug) {
+			s.logger.Log(LogLevelDebug, "server denied connection response. server is draining", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
+		}
+		s.sendDeniedPacket(sendKey, addr)
+		return
+	}
+
+	if s.accessList != nil && s.accessList.IsBanned(challengeToken.ClientId, addr) {
+		s.logger.Log(LogLevelInfo, "server denied connection response. client is banned", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
+		s.sendDeniedPacket(sendKey, addr)
+		return
 	}
 
 	if s.clientManager.ConnectedClientCount() == s.maxClients {
-		log.Printf("server denied connection response. server is full\n")
+		s.logger.Log(LogLevelInfo, "server denied connection response. server is full", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
 		s.sendDeniedPacket(sendKey, addr)
 		return
 	}
 
+	tokenSequence := s.clientManager.getEncryptionEntryTokenSequence(encryptionIndex)
+	admissionRequest := newAdmissionRequest(challengeToken.ClientId, addr, challengeToken.UserData.Bytes(), tokenSequence, true)
+	if !s.admit(admissionRequest, sendKey) {
+		return
+	}
+
 	s.connectClient(encryptionIndex, challengeToken, addr)
 	return
 
@@ -400,32 +800,31 @@ func (s *Server) sendDeniedPacket(sendKey []byte, addr *net.UDPAddr) {
 	var err error
 
 	deniedPacket := &DeniedPacket{}
-	packetBuffer := make([]byte, MAX_PACKET_BYTES)
-	if bytesWritten, err = deniedPacket.Write(packetBuffer, s.protocolId, s.incGlobalSequence(), sendKey); err != nil {
-		log.Printf("error creating denied packet: %s\n", err)
+	if bytesWritten, err = deniedPacket.Write(s.packetBuffer, s.protocolId, s.incGlobalSequence(), sendKey); err != nil {
+		s.logger.Log(LogLevelError, "server error creating denied packet", fieldAddress(addr), fieldError(err))
 		return
 	}
+	s.stats.addDenied()
 
-	s.sendGlobalPacket(packetBuffer[:bytesWritten], addr)
+	s.sendGlobalPacket(s.packetBuffer[:bytesWritten], addr)
 }
 
 func (s *Server) connectClient(encryptionIndex int, challengeToken *ChallengeToken, addr *net.UDPAddr) {
 	if s.clientManager.ConnectedClientCount() > s.maxClients {
-		log.Printf("maxium number of clients reached")
+		s.logger.Log(LogLevelInfo, "server maximum number of clients reached", fieldClientId(challengeToken.ClientId), fieldAddress(addr))
 		return
 	}
 
 	s.clientManager.SetEncryptionEntryExpiration(encryptionIndex, -1)
-	client := s.clientManager.ConnectClient(addr, challengeToken)
+	client := s.clientManager.ConnectClient(addr, challengeToken, s.serverTime)
 	if client == nil {
 		return
 	}
-	client.serverConn = s.serverConn
+	client.serverConn = s.recvConn
 	client.encryptionIndex = encryptionIndex
 	client.protocolId = s.protocolId
-	client.lastSendTime = s.serverTime
-	client.lastRecvTime = s.serverTime
-	log.Printf("server accepted client %d from %s in slot: %d\n", client.clientId, addr.String(), client.clientIndex)
+	s.logger.Log(LogLevelInfo, "server accepted client", fieldClientId(client.clientId), fieldClientIndex(client.clientIndex), fieldAddress(addr))
+	s.clientManager.emitEvent(EventClientConnected, client)
 	s.sendKeepAlive(client)
 }
 
@@ -436,19 +835,19 @@ func (s *Server) sendKeepAlive(client *ClientInstance) {
 	packet.MaxClients = uint32(s.maxClients)
 
 	if !s.clientManager.TouchEncryptionEntry(client.encryptionIndex, client.address, s.serverTime) {
-		log.Printf("error: encryption mapping is out of date for client %d encIndex: %d addr: %s\n", clientIndex, client.encryptionIndex, client.address.String())
+		s.logger.Log(LogLevelError, "encryption mapping is out of date", fieldClientId(client.clientId), fieldClientIndex(clientIndex), LogField{"encryptionIndex", client.encryptionIndex}, fieldAddress(client.address))
 		panic("bloop")
 		return
 	}
 
 	writePacketKey := s.clientManager.GetEncryptionEntrySendKey(client.encryptionIndex)
 	if writePacketKey == nil {
-		log.Printf("error: unable to retrieve encryption key for client: %d\n", clientIndex)
+		s.logger.Log(LogLevelError, "unable to retrieve encryption key for client", fieldClientId(client.clientId), fieldClientIndex(clientIndex))
 		return
 	}
 
 	if err := client.SendPacket(packet, writePacketKey, s.serverTime); err != nil {
-		log.Printf("%s\n", err)
+		s.logger.Log(LogLevelError, "server error sending keep-alive", fieldClientId(client.clientId), fieldClientIndex(clientIndex), fieldError(err))
 	}
 }
 
@@ -466,6 +865,7 @@ func (s *Server) HasClients() int {
 
 func (s *Server) Stop() error {
 	if !s.running {
+		s.finishDrain()
 		return nil
 	}
 	s.clientManager.disconnectClients(s.serverTime)
@@ -475,15 +875,26 @@ func (s *Server) Stop() error {
 	s.globalSequence = 0
 	s.challengeSequence = 0
 	s.challengeKey = make([]byte, KEY_BYTES)
+	s.challenge = challengeKeys{interval: s.challenge.interval, overlap: s.challenge.overlap, rotateTime: -1}
 	s.clientManager.resetCryptoEntries()
 	s.clientManager.resetTokenEntries()
+	s.finishDrain()
 	close(s.shutdownCh)
 	s.running = false
-	s.serverConn.Close()
+	for _, conn := range s.serverConns {
+		conn.Close()
+	}
+	s.recvConn = nil
+	if s.decrypt != nil {
+		s.decrypt.stop()
+		s.decrypt = nil
+	}
 
 	return nil
 }
 
+// Returns a copy of the next payload received from the client and its sequence, the packet is
+// returned to the pool. Use RecvPayloadPacket to avoid allocating the copy.
 func (s *Server) RecvPayload(clientIndex int) ([]byte, uint64) {
 	packet := s.clientManager.instances[clientIndex].packetQueue.Pop()
 	if packet == nil {
@@ -491,12 +902,21 @@ func (s *Server) RecvPayload(clientIndex int) ([]byte, uint64) {
 	}
 	p, ok := packet.(*PayloadPacket)
 	if !ok {
-		log.Printf("not a payload packet")
+		s.logger.Log(LogLevelError, "server recv'd packet was not a payload packet", fieldClientIndex(clientIndex))
 		return []byte{}, 0
 	}
-	return p.PayloadData, p.sequence
+	return p.copyAndRelease()
+}
+
+// Returns the next payload received from the client, or nil if there are none. Unlike
+// RecvPayload the payload's buffer is reused once Release is called on the packet.
+func (s *Server) RecvPayloadPacket(clientIndex int) *PayloadPacket {
+	p, _ := s.clientManager.instances[clientIndex].packetQueue.Pop().(*PayloadPacket)
+	return p
 }
 
+// IPv4-mapped IPv6 addresses are equal to their IPv4 form, so a client seen through a
+// dual-stack socket matches the same client seen through an IPv4 socket.
 func addressEqual(addr1, addr2 *net.UDPAddr) bool {
 	if addr1 == nil || addr2 == nil {
 		return false
@@ -0,0 +1,53 @@
+package netcode
+
+import "net"
+
+// The type of event that occurred for a client slot on the server
+type ServerEventType int
+
+const (
+	EventClientConnected    ServerEventType = iota // client completed the handshake and was assigned a slot
+	EventClientConfirmed                           // server recv'd the first keep-alive or payload from the client
+	EventClientTimedOut                            // client stopped sending packets for longer than the timeout
+	EventClientDisconnected                        // client sent us a disconnect packet
+	EventClientKicked                              // server disconnected the client
+	EventServerDrained                             // server finished draining, ClientIndex is -1
+)
+
+// reference map of event -> string values
+var serverEventMap = map[ServerEventType]string{
+	EventClientConnected:    "client connected",
+	EventClientConfirmed:    "client confirmed",
+	EventClientTimedOut:     "client timed out",
+	EventClientDisconnected: "client disconnected",
+	EventClientKicked:       "client kicked",
+	EventServerDrained:      "server drained",
+}
+
+func (t ServerEventType) String() string {
+	return serverEventMap[t]
+}
+
+// Details of the client the event occurred for. UserData is a copy and is
+// safe to retain after the handler returns.
+type ServerEvent struct {
+	Type        ServerEventType
+	ClientId    uint64
+	ClientIndex int
+	Address     *net.UDPAddr
+	UserData    []byte
+}
+
+// Called from within Server.Update (or Stop) whenever a client slot changes state.
+type ServerEventHandler func(event *ServerEvent)
+
+func newServerEvent(eventType ServerEventType, client *ClientInstance) *ServerEvent {
+	event := &ServerEvent{}
+	event.Type = eventType
+	event.ClientId = client.clientId
+	event.ClientIndex = client.clientIndex
+	event.Address = client.address
+	event.UserData = make([]byte, len(client.userData))
+	copy(event.UserData, client.userData)
+	return event
+}
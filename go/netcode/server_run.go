@@ -0,0 +1,170 @@
+package netcode
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_TICK_RATE = 60.0 // default number of Update calls per second in Run mode
+
+// A payload recv'd from a client while the server is driven by Run.
+type ServerPayload struct {
+	ClientId    uint64
+	ClientIndex int
+	Sequence    uint64
+	Data        []byte
+}
+
+// A payload queued via Send or Broadcast, applied on the next tick.
+type serverCommand struct {
+	clientId    uint64
+	broadcast   bool
+	payloadData []byte
+}
+
+// Sets the number of ticks per second used by Run.
+func (s *Server) SetTickRate(ticksPerSecond float64) {
+	s.tickRate = ticksPerSecond
+}
+
+// Returns the channel payloads are delivered on while the server is driven by Run.
+// The channel is closed when Run returns.
+func (s *Server) Payloads() <-chan *ServerPayload {
+	return s.payloadCh
+}
+
+// Returns the channel connection events are delivered on while the server is driven by Run.
+// Any handler set via SetEventHandler is still called. The channel is closed when Run returns.
+func (s *Server) Events() <-chan *ServerEvent {
+	return s.eventCh
+}
+
+// Queues the payload for the client, may be called from any goroutine while the server
+// is driven by Run. The payload is copied so the caller may re-use the buffer.
+func (s *Server) Send(clientId uint64, payloadData []byte) error {
+	return s.queueCommand(&serverCommand{clientId: clientId, payloadData: payloadData})
+}
+
+// Queues the payload for all connected clients, may be called from any goroutine while
+// the server is driven by Run. The payload is copied so the caller may re-use the buffer.
+func (s *Server) Broadcast(payloadData []byte) error {
+	return s.queueCommand(&serverCommand{broadcast: true, payloadData: payloadData})
+}
+
+func (s *Server) queueCommand(command *serverCommand) error {
+	if atomic.LoadInt32(&s.runState) != 1 {
+		return errors.New("server is not being driven by Run")
+	}
+
+	if len(command.payloadData) > MAX_PAYLOAD_BYTES {
+		return errors.New("payload is too large")
+	}
+
+	payloadData := make([]byte, len(command.payloadData))
+	copy(payloadData, command.payloadData)
+	command.payloadData = payloadData
+
+	select {
+	case s.commandCh <- command:
+		return nil
+	default:
+		return errors.New("server send queue is full")
+	}
+}
+
+// Drives the server at the tick rate until the context is cancelled, at which point the
+// server is stopped, or until the server has been drained via Drain in which case nil is
+// returned. Init and Listen must be called prior to Run. Received payloads and
+// connection events are delivered on the Payloads and Events channels, which must be
+// drained by the caller or the tick will block.
+func (s *Server) Run(ctx context.Context) error {
+	if !s.running {
+		return errors.New("server is not running, Init and Listen must be called before Run")
+	}
+
+	if !atomic.CompareAndSwapInt32(&s.runState, 0, 1) {
+		return errors.New("server is already being driven by Run")
+	}
+
+	defer func() {
+		atomic.StoreInt32(&s.runState, 2)
+		close(s.payloadCh)
+		close(s.eventCh)
+	}()
+
+	eventHandlerFn := s.clientManager.eventHandlerFn
+	s.clientManager.setEventHandler(func(event *ServerEvent) {
+		if eventHandlerFn != nil {
+			eventHandlerFn(event)
+		}
+		select {
+		case s.eventCh <- event:
+		case <-ctx.Done():
+		}
+	})
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / s.tickRate))
+	defer ticker.Stop()
+
+	// the system clock's times carry a monotonic reading, so serverTime is unaffected by wall clock changes.
+	startTime := s.clock.Now()
+	baseTime := s.serverTime
+	for {
+		select {
+		case <-ctx.Done():
+			s.Stop()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		if err := s.tick(ctx, baseTime+s.clock.Now().Sub(startTime).Seconds()); err != nil {
+			return err
+		}
+
+		// stopped by Drain
+		if !s.running {
+			return nil
+		}
+	}
+}
+
+// a single iteration of Run, updates the server, delivers payloads and applies queued sends.
+func (s *Server) tick(ctx context.Context, serverTime float64) error {
+	if err := s.Update(serverTime); err != nil {
+		return err
+	}
+
+	for clientIndex := 0; clientIndex < s.maxClients; clientIndex += 1 {
+		client := s.clientManager.instances[clientIndex]
+		for {
+			payloadData, sequence := s.RecvPayload(clientIndex)
+			if len(payloadData) == 0 {
+				break
+			}
+
+			payload := &ServerPayload{ClientId: client.clientId, ClientIndex: clientIndex, Sequence: sequence, Data: payloadData}
+			select {
+			case s.payloadCh <- payload:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+
+	for {
+		select {
+		case command := <-s.commandCh:
+			if command.broadcast {
+				s.SendPayloads(command.payloadData, serverTime)
+			} else if err := s.SendPayloadToClient(command.clientId, command.payloadData, serverTime); err != nil {
+				if logEnabled(s.logger, LogLevelDebug) {
+					s.logger.Log(LogLevelDebug, "server dropped queued payload", fieldClientId(command.clientId), fieldError(err))
+				}
+			}
+		default:
+			return nil
+		}
+	}
+}
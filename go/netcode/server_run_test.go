@@ -0,0 +1,109 @@
+package netcode
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerRun(t *testing.T) {
+	maxClients := 4
+	addr := net.UDPAddr{IP: net.ParseIP("::1"), Port: 40001}
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, maxClients)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+
+	if err := serv.Broadcast([]byte("hello")); err == nil {
+		t.Fatalf("expected error sending before Run\n")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErrCh := make(chan error, 1)
+	go func() {
+		runErrCh <- serv.Run(ctx)
+	}()
+
+	servers := []net.UDPAddr{addr}
+	connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+	client := NewClient(connectToken)
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	defer client.Close()
+
+	var clientRecv uint32
+	clientDoneCh := make(chan struct{})
+	go func() {
+		defer close(clientDoneCh)
+		clientTime := float64(0)
+		for ctx.Err() == nil {
+			client.Update(clientTime)
+			if client.GetState() == StateConnected {
+				client.SendData([]byte("ping"))
+			}
+			for {
+				if payload, _ := client.RecvData(); payload == nil {
+					break
+				}
+				atomic.AddUint32(&clientRecv, 1)
+			}
+			time.Sleep(10 * time.Millisecond)
+			clientTime += 0.01
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	select {
+	case event := <-serv.Events():
+		if event.Type != EventClientConnected || event.ClientId != TEST_CLIENT_ID {
+			t.Fatalf("expected connected event for %d got %s for %d\n", TEST_CLIENT_ID, event.Type, event.ClientId)
+		}
+	case <-timeout:
+		t.Fatalf("timed out waiting for connected event\n")
+	}
+
+	select {
+	case payload := <-serv.Payloads():
+		if payload.ClientId != TEST_CLIENT_ID || string(payload.Data) != "ping" {
+			t.Fatalf("unexpected payload %#v\n", payload)
+		}
+	case <-timeout:
+		t.Fatalf("timed out waiting for payload\n")
+	}
+
+	if err := serv.Send(TEST_CLIENT_ID, []byte("pong")); err != nil {
+		t.Fatalf("error queueing send: %s\n", err)
+	}
+
+	// keep draining so the tick never blocks while waiting on the client
+	for atomic.LoadUint32(&clientRecv) == 0 {
+		select {
+		case <-serv.Payloads():
+		case <-serv.Events():
+		case <-timeout:
+			t.Fatalf("timed out waiting for client to recv payload\n")
+		}
+	}
+
+	cancel()
+	<-clientDoneCh
+	for range serv.Payloads() {
+	}
+	for range serv.Events() {
+	}
+
+	if err := <-runErrCh; err != context.Canceled {
+		t.Fatalf("expected context.Canceled from Run got: %v\n", err)
+	}
+
+	if err := serv.Broadcast([]byte("hello")); err == nil {
+		t.Fatalf("expected error sending after Run returned\n")
+	}
+}
@@ -64,6 +64,8 @@ func runTestServer(sendFunc SendFunc, doneCh chan struct{}, t *testing.T) {
 	for {
 		serv.Update(serverTime)
 		if count > 0 && payloadCount > 0 {
+			// release the port before the next test listens on it
+			serv.Stop()
 			close(doneCh)
 			return
 		}
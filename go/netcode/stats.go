@@ -0,0 +1,163 @@
+package netcode
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// Traffic counters kept for the server, each client slot and the client. Counters are
+// updated atomically so a snapshot may be taken from any goroutine.
+type TrafficStats struct {
+	PacketsSent      uint64 // packets written to the socket
+	PacketsReceived  uint64 // packets handed to the server/client by the socket
+	BytesSent        uint64 // bytes written to the socket
+	BytesReceived    uint64 // bytes handed to the server/client by the socket
+	DecryptFailures  uint64 // packets or connect tokens that failed to decrypt
+	ReplayRejections uint64 // packets dropped by replay protection
+	QueueOverflows   uint64 // payloads dropped because the packet queue was full
+}
+
+// Server wide counters, the embedded TrafficStats is the total across all client slots
+// plus packets sent to or recv'd from addresses not yet connected.
+type ServerStats struct {
+	TrafficStats
+	ConnectedClients          uint64 // number of currently connected clients
+	ConnectionRequestsDenied  uint64 // connection requests/responses answered with a denied packet
+	ConnectionRequestsIgnored uint64 // connection requests/responses silently dropped
+	RateLimited               uint64 // connection requests/responses dropped by the rate limiter
+	BacklogDropped            uint64 // connection requests/responses dropped because the server packet channel was full
+}
+
+func (t *TrafficStats) addSent(bytes int) {
+	atomic.AddUint64(&t.PacketsSent, 1)
+	atomic.AddUint64(&t.BytesSent, uint64(bytes))
+}
+
+func (t *TrafficStats) addReceived(bytes int) {
+	atomic.AddUint64(&t.PacketsReceived, 1)
+	atomic.AddUint64(&t.BytesReceived, uint64(bytes))
+}
+
+func (t *TrafficStats) addQueueOverflow() {
+	atomic.AddUint64(&t.QueueOverflows, 1)
+}
+
+// increments the counter matching the type of error returned from Packet.Read
+func (t *TrafficStats) addReadError(err error) {
+	switch err.(type) {
+	case *decryptError:
+		atomic.AddUint64(&t.DecryptFailures, 1)
+	case *replayError:
+		atomic.AddUint64(&t.ReplayRejections, 1)
+	}
+}
+
+func (t *TrafficStats) snapshot() TrafficStats {
+	return TrafficStats{
+		PacketsSent:      atomic.LoadUint64(&t.PacketsSent),
+		PacketsReceived:  atomic.LoadUint64(&t.PacketsReceived),
+		BytesSent:        atomic.LoadUint64(&t.BytesSent),
+		BytesReceived:    atomic.LoadUint64(&t.BytesReceived),
+		DecryptFailures:  atomic.LoadUint64(&t.DecryptFailures),
+		ReplayRejections: atomic.LoadUint64(&t.ReplayRejections),
+		QueueOverflows:   atomic.LoadUint64(&t.QueueOverflows),
+	}
+}
+
+func (t *TrafficStats) reset() {
+	atomic.StoreUint64(&t.PacketsSent, 0)
+	atomic.StoreUint64(&t.PacketsReceived, 0)
+	atomic.StoreUint64(&t.BytesSent, 0)
+	atomic.StoreUint64(&t.BytesReceived, 0)
+	atomic.StoreUint64(&t.DecryptFailures, 0)
+	atomic.StoreUint64(&t.ReplayRejections, 0)
+	atomic.StoreUint64(&t.QueueOverflows, 0)
+}
+
+func (s *ServerStats) addDenied() {
+	atomic.AddUint64(&s.ConnectionRequestsDenied, 1)
+}
+
+func (s *ServerStats) addIgnored() {
+	atomic.AddUint64(&s.ConnectionRequestsIgnored, 1)
+}
+
+func (s *ServerStats) addRateLimited() {
+	atomic.AddUint64(&s.RateLimited, 1)
+}
+
+func (s *ServerStats) addBacklogDropped() {
+	atomic.AddUint64(&s.BacklogDropped, 1)
+}
+
+func (s *ServerStats) addConnected() {
+	atomic.AddUint64(&s.ConnectedClients, 1)
+}
+
+func (s *ServerStats) removeConnected() {
+	atomic.AddUint64(&s.ConnectedClients, ^uint64(0))
+}
+
+func (s *ServerStats) snapshot() ServerStats {
+	return ServerStats{
+		TrafficStats:              s.TrafficStats.snapshot(),
+		ConnectedClients:          atomic.LoadUint64(&s.ConnectedClients),
+		ConnectionRequestsDenied:  atomic.LoadUint64(&s.ConnectionRequestsDenied),
+		ConnectionRequestsIgnored: atomic.LoadUint64(&s.ConnectionRequestsIgnored),
+		RateLimited:               atomic.LoadUint64(&s.RateLimited),
+		BacklogDropped:            atomic.LoadUint64(&s.BacklogDropped),
+	}
+}
+
+// Returns a snapshot of the server wide counters, safe to call from any goroutine.
+func (s *Server) Stats() ServerStats {
+	return s.stats.snapshot()
+}
+
+// Returns a snapshot of the counters for the connected client. Counters are reset when
+// the client disconnects. Must be called from the same goroutine as Update.
+func (s *Server) ClientStats(clientId uint64) (TrafficStats, error) {
+	clientIndex, err := s.getClientIndexByClientId(clientId)
+	if err != nil {
+		return TrafficStats{}, err
+	}
+	return s.clientManager.instances[clientIndex].stats.snapshot(), nil
+}
+
+// Returns a snapshot of the client's counters, safe to call from any goroutine.
+func (c *Client) Stats() TrafficStats {
+	return c.stats.snapshot()
+}
+
+// Returns an http.Handler which writes the server wide counters in the Prometheus text
+// exposition format, suitable for registering as a /metrics endpoint.
+func (s *Server) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusStats(w, s.Stats())
+		if keyRing := s.keyRing; keyRing != nil {
+			writePrometheusKeyStats(w, keyRing.Stats())
+		}
+	})
+}
+
+func writePrometheusStats(w io.Writer, stats ServerStats) {
+	writePrometheusMetric(w, "netcode_server_packets_sent_total", "counter", "Packets written to the socket.", stats.PacketsSent)
+	writePrometheusMetric(w, "netcode_server_packets_received_total", "counter", "Packets recv'd from the socket.", stats.PacketsReceived)
+	writePrometheusMetric(w, "netcode_server_bytes_sent_total", "counter", "Bytes written to the socket.", stats.BytesSent)
+	writePrometheusMetric(w, "netcode_server_bytes_received_total", "counter", "Bytes recv'd from the socket.", stats.BytesReceived)
+	writePrometheusMetric(w, "netcode_server_decrypt_failures_total", "counter", "Packets or connect tokens that failed to decrypt.", stats.DecryptFailures)
+	writePrometheusMetric(w, "netcode_server_replay_rejections_total", "counter", "Packets dropped by replay protection.", stats.ReplayRejections)
+	writePrometheusMetric(w, "netcode_server_queue_overflows_total", "counter", "Payloads dropped because a client packet queue was full.", stats.QueueOverflows)
+	writePrometheusMetric(w, "netcode_server_connection_requests_denied_total", "counter", "Connection requests answered with a denied packet.", stats.ConnectionRequestsDenied)
+	writePrometheusMetric(w, "netcode_server_connection_requests_ignored_total", "counter", "Connection requests silently dropped.", stats.ConnectionRequestsIgnored)
+	writePrometheusMetric(w, "netcode_server_rate_limited_total", "counter", "Connection requests dropped by the rate limiter.", stats.RateLimited)
+	writePrometheusMetric(w, "netcode_server_backlog_dropped_total", "counter", "Connection requests dropped because the server packet channel was full.", stats.BacklogDropped)
+	writePrometheusMetric(w, "netcode_server_connected_clients", "gauge", "Currently connected clients.", stats.ConnectedClients)
+}
+
+func writePrometheusMetric(w io.Writer, name, metricType, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, metricType, name, value)
+}
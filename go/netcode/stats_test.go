@@ -0,0 +1,92 @@
+package netcode
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrafficStatsReadErrors(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	wrongKey, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("error generating key: %s\n", err)
+	}
+
+	allowedPackets := make([]byte, ConnectionNumPackets)
+	allowedPackets[ConnectionKeepAlive] = 1
+
+	writePacket := func(sequence uint64) []byte {
+		buffer := make([]byte, MAX_PACKET_BYTES)
+		packet := &KeepAlivePacket{ClientIndex: 1, MaxClients: 2}
+		bytesWritten, err := packet.Write(buffer, TEST_PROTOCOL_ID, sequence, key)
+		if err != nil {
+			t.Fatalf("error writing packet: %s\n", err)
+		}
+		return buffer[:bytesWritten]
+	}
+
+	stats := &TrafficStats{}
+	replayProtection := NewReplayProtection()
+
+	data := writePacket(10)
+	if err := NewPacket(data).Read(data, len(data), TEST_PROTOCOL_ID, 0, wrongKey, nil, allowedPackets, replayProtection); err == nil {
+		t.Fatalf("expected error reading packet with wrong key\n")
+	} else {
+		stats.addReadError(err)
+	}
+
+	data = writePacket(11)
+	if err := NewPacket(data).Read(data, len(data), TEST_PROTOCOL_ID, 0, key, nil, allowedPackets, replayProtection); err != nil {
+		t.Fatalf("error reading packet: %s\n", err)
+	}
+
+	data = writePacket(11)
+	if err := NewPacket(data).Read(data, len(data), TEST_PROTOCOL_ID, 0, key, nil, allowedPackets, replayProtection); err == nil {
+		t.Fatalf("expected replay protection error\n")
+	} else {
+		stats.addReadError(err)
+	}
+
+	snapshot := stats.snapshot()
+	if snapshot.DecryptFailures != 1 || snapshot.ReplayRejections != 1 {
+		t.Fatalf("expected 1 decrypt failure and 1 replay rejection got: %#v\n", snapshot)
+	}
+
+	stats.reset()
+	if stats.snapshot() != (TrafficStats{}) {
+		t.Fatalf("expected stats to be reset\n")
+	}
+}
+
+func TestServerStatsHandler(t *testing.T) {
+	serv := NewServer(nil, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 2)
+	serv.stats.addSent(100)
+	serv.stats.addReceived(50)
+	serv.stats.addDenied()
+	serv.stats.addConnected()
+
+	recorder := httptest.NewRecorder()
+	serv.StatsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	expected := []string{
+		"# TYPE netcode_server_packets_sent_total counter",
+		"netcode_server_packets_sent_total 1\n",
+		"netcode_server_bytes_sent_total 100\n",
+		"netcode_server_bytes_received_total 50\n",
+		"netcode_server_connection_requests_denied_total 1\n",
+		"# TYPE netcode_server_connected_clients gauge",
+		"netcode_server_connected_clients 1\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Fatalf("expected %q in stats output:\n%s\n", line, body)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package netcode
+
+import (
+	"container/heap"
+)
+
+// A deadline for one client or entry slot. Times which only move a deadline later, such as the
+// last send, recv or access time, do not reschedule the timer. They are checked when the timer
+// fires and the timer is pushed back if it is not due yet.
+type timer struct {
+	deadline float64
+	slot     int
+	index    int // position in the heap, -1 when not scheduled
+}
+
+func newTimer(slot int) timer {
+	return timer{slot: slot, index: -1}
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].deadline < h[j].deadline }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
+
+// min-heap of timers so each Update only visits the slots which are due.
+type timerQueue struct {
+	timers timerHeap
+	due    []*timer
+}
+
+func newTimerQueue(capacity int) *timerQueue {
+	q := &timerQueue{}
+	q.timers = make(timerHeap, 0, capacity)
+	q.due = make([]*timer, 0, capacity)
+	return q
+}
+
+// schedules the timer, or moves it if it is already scheduled.
+func (q *timerQueue) schedule(t *timer, deadline float64) {
+	t.deadline = deadline
+	if t.index < 0 {
+		heap.Push(&q.timers, t)
+		return
+	}
+	heap.Fix(&q.timers, t.index)
+}
+
+func (q *timerQueue) cancel(t *timer) {
+	if t.index >= 0 {
+		heap.Remove(&q.timers, t.index)
+	}
+}
+
+// removes and returns the timers due at or before now. The slice is reused by the next call.
+func (q *timerQueue) popDue(now float64) []*timer {
+	q.due = q.due[:0]
+	for len(q.timers) > 0 {
+		t := q.timers[0]
+		if t.deadline > now && !floatEquals(t.deadline, now) {
+			break
+		}
+		heap.Pop(&q.timers)
+		q.due = append(q.due, t)
+	}
+	return q.due
+}
+
+// makes every scheduled timer due so it is checked again, used when a deadline may have moved
+// earlier such as the timeout being lowered.
+func (q *timerQueue) recheckAll() {
+	for _, t := range q.timers {
+		t.deadline = -1
+	}
+}
+
+// returns the timer with the earliest deadline without removing it, nil if none are scheduled.
+func (q *timerQueue) first() *timer {
+	if len(q.timers) == 0 {
+		return nil
+	}
+	return q.timers[0]
+}
+
+func (q *timerQueue) Len() int {
+	return len(q.timers)
+}
@@ -0,0 +1,165 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTimerQueue(t *testing.T) {
+	q := newTimerQueue(4)
+	timers := make([]timer, 4)
+	for i := range timers {
+		timers[i] = newTimer(i)
+	}
+
+	q.schedule(&timers[0], 3)
+	q.schedule(&timers[1], 1)
+	q.schedule(&timers[2], 2)
+	q.schedule(&timers[3], 5)
+
+	// moving a scheduled timer earlier
+	q.schedule(&timers[3], 0.5)
+	q.cancel(&timers[2])
+
+	due := q.popDue(1)
+	if len(due) != 2 || due[0].slot != 3 || due[1].slot != 1 {
+		t.Fatalf("expected slots 3 and 1 to be due in deadline order\n")
+	}
+
+	if len(q.popDue(2.9)) != 0 {
+		t.Fatalf("expected no timers due before the next deadline\n")
+	}
+
+	due = q.popDue(3)
+	if len(due) != 1 || due[0].slot != 0 || q.Len() != 0 {
+		t.Fatalf("expected last timer to be due\n")
+	}
+
+	for i := range timers {
+		if timers[i].index != -1 {
+			t.Fatalf("expected timer %d to be unscheduled\n", i)
+		}
+	}
+}
+
+func TestClientManagerTimers(t *testing.T) {
+	timeout := float64(4)
+	maxClients := 4
+	servers := make([]net.UDPAddr, 1)
+	servers[0] = net.UDPAddr{IP: net.ParseIP("::1"), Port: 40000}
+	connectToken := testGenerateConnectToken(servers, TEST_PRIVATE_KEY, t)
+
+	cm := NewClientManager(timeout, maxClients)
+
+	serverTime := float64(1.0)
+	clients := make([]*ClientInstance, maxClients)
+	for i := range clients {
+		addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62424 + i}
+		if !cm.AddEncryptionMapping(connectToken.PrivateData, addr, serverTime, serverTime+timeout) {
+			t.Fatalf("error adding encryption mapping\n")
+		}
+		clients[i] = cm.ConnectClient(addr, NewChallengeToken(TEST_CLIENT_ID+uint64(i)), serverTime)
+		clients[i].encryptionIndex = cm.FindEncryptionEntryIndex(addr, serverTime)
+		cm.SetEncryptionEntryExpiration(clients[i].encryptionIndex, -1)
+	}
+
+	// timers are scheduled from the time the client connected
+	if clients[0].keepAliveTimer.deadline != serverTime+1.0/PACKET_SEND_RATE || clients[0].timeoutTimer.deadline != serverTime+timeout {
+		t.Fatalf("expected timers scheduled from the connect time got keep-alive %v timeout %v\n", clients[0].keepAliveTimer.deadline, clients[0].timeoutTimer.deadline)
+	}
+
+	// every client keeps receiving except the first
+	for step := 1; step <= 5; step += 1 {
+		serverTime += 1
+		for _, client := range clients[1:] {
+			client.lastRecvTime = serverTime
+			cm.TouchEncryptionEntry(client.encryptionIndex, client.address, serverTime)
+		}
+		cm.CheckTimeouts(serverTime)
+	}
+
+	if clients[0].connected || cm.ConnectedClientCount() != maxClients-1 {
+		t.Fatalf("expected only the silent client to time out\n")
+	}
+
+	if cm.keepAliveTimers.Len() != maxClients-1 || cm.timeoutTimers.Len() != maxClients-1 {
+		t.Fatalf("expected timed out client timers to be cancelled\n")
+	}
+
+	// the handshake entry of a client which never connected expires and is swept
+	pending := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62524}
+	if !cm.AddEncryptionMapping(connectToken.PrivateData, pending, serverTime, serverTime+timeout) {
+		t.Fatalf("error adding encryption mapping\n")
+	}
+
+	if !cm.findOrAddTokenEntry(connectToken.PrivateData.Mac(), pending, serverTime, serverTime+1) {
+		t.Fatalf("error adding token entry\n")
+	}
+
+	cm.CheckTimeouts(serverTime + 2)
+	if _, ok := cm.cryptoByAddress[newAddrKey(pending)]; !ok {
+		t.Fatalf("expected encryption entry to be kept before it expires\n")
+	}
+
+	if len(cm.tokensByMac) != 0 || cm.tokenTimers.Len() != 0 {
+		t.Fatalf("expected expired token entry to be swept\n")
+	}
+
+	serverTime += timeout + 0.5
+	for _, client := range clients[1:] {
+		client.lastRecvTime = serverTime
+		cm.TouchEncryptionEntry(client.encryptionIndex, client.address, serverTime)
+	}
+
+	cm.CheckTimeouts(serverTime)
+	if _, ok := cm.cryptoByAddress[newAddrKey(pending)]; ok {
+		t.Fatalf("expected expired encryption entry to be swept\n")
+	}
+
+	for _, client := range clients[1:] {
+		if cm.FindClientIndexByAddress(client.address) == -1 || cm.FindEncryptionEntryIndex(client.address, serverTime) != client.encryptionIndex {
+			t.Fatalf("expected connected clients to keep their encryption entries\n")
+		}
+	}
+}
+
+func TestTokenEntrySweepReusesEntry(t *testing.T) {
+	cm := NewClientManager(float64(4), 1)
+	addr := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62424}
+	addr2 := &net.UDPAddr{IP: net.ParseIP("::1"), Port: 62425}
+
+	// every entry is live, the second expires first
+	serverTime := float64(1.0)
+	macs := make([][]byte, cm.maxEntries+1)
+	for i := range macs {
+		macs[i] = make([]byte, MAC_BYTES)
+		macs[i][0] = byte(i + 1)
+	}
+
+	for i := 0; i < cm.maxEntries; i += 1 {
+		expireTime := float64(-1)
+		if i == 1 {
+			expireTime = serverTime + 1
+		}
+
+		if !cm.findOrAddTokenEntry(macs[i], addr, serverTime, expireTime) {
+			t.Fatalf("expected token entry %d to be added\n", i)
+		}
+	}
+
+	cm.CheckTimeouts(serverTime + 2)
+	if cm.tokenTimers.Len() != 0 {
+		t.Fatalf("expected expired token entry to be swept\n")
+	}
+
+	// the new token takes the swept entry instead of replacing a live one
+	if !cm.findOrAddTokenEntry(macs[cm.maxEntries], addr, serverTime+2, -1) {
+		t.Fatalf("expected new token entry to be added\n")
+	}
+
+	for i := 0; i < cm.maxEntries; i += 1 {
+		if i != 1 && cm.findOrAddTokenEntry(macs[i], addr2, serverTime+2, -1) {
+			t.Fatalf("expected live token entry %d to be rejected from a different address\n", i)
+		}
+	}
+}
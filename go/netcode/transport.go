@@ -0,0 +1,205 @@
+package netcode
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Transport is the datagram socket a NetcodeConn reads from and writes to. Any net.PacketConn
+// satisfies it, and NetcodeConn opens a UDP socket when no Transport is set. Addresses passed
+// to WriteTo are always *net.UDPAddr, and ReadFrom must return them too as connect tokens and
+// clients are identified by UDP address.
+type Transport interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// Packets queued for each MemoryTransport before further writes to it are dropped.
+const MEMORY_TRANSPORT_QUEUE_SIZE = 1024
+
+// An in-memory network of transports addressed by UDP address, for running servers and clients
+// in the same process without opening sockets. Like UDP, packets written to an address nobody is
+// listening on, or to a transport whose queue is full, are dropped.
+type MemoryNetwork struct {
+	mu         sync.Mutex
+	transports map[addrKey]*MemoryTransport
+	inFlight   int        // packets queued or being handled by a reader, see WaitDelivered
+	delivered  *sync.Cond // signalled when inFlight reaches 0
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	n := &MemoryNetwork{}
+	n.transports = make(map[addrKey]*MemoryTransport)
+	n.delivered = sync.NewCond(&n.mu)
+	return n
+}
+
+// Waits until every packet written has been handled by its reader, returning false if the
+// timeout passes first. A packet is handled once the reader calls ReadFrom again, so when a
+// NetcodeConn reads the transport the packet has been handed to the server or client and
+// will be processed by its next Update. Used to step servers and clients deterministically.
+func (n *MemoryNetwork) WaitDelivered(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		n.mu.Lock()
+		n.delivered.Broadcast()
+		n.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for n.inFlight > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		n.delivered.Wait()
+	}
+	return true
+}
+
+func (n *MemoryNetwork) handled(count int) {
+	n.mu.Lock()
+	n.handledLocked(count)
+	n.mu.Unlock()
+}
+
+func (n *MemoryNetwork) handledLocked(count int) {
+	n.inFlight -= count
+	if n.inFlight == 0 {
+		n.delivered.Broadcast()
+	}
+}
+
+// Returns a transport bound to the address, or an error if the address is already in use.
+func (n *MemoryNetwork) Listen(addr *net.UDPAddr) (*MemoryTransport, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := newAddrKey(addr)
+	if _, ok := n.transports[key]; ok {
+		return nil, errors.New("memory transport address already in use: " + addr.String())
+	}
+
+	t := &MemoryTransport{network: n, addr: addr}
+	t.recvCh = make(chan memoryPacket, MEMORY_TRANSPORT_QUEUE_SIZE)
+	t.closeCh = make(chan struct{})
+	n.transports[key] = t
+	return t, nil
+}
+
+// queues a copy of the packet for the transport listening on the address, if any and if its
+// queue has room.
+func (n *MemoryNetwork) send(b []byte, from, to *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	dest := n.transports[newAddrKey(to)]
+	if dest == nil {
+		return
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	select {
+	case dest.recvCh <- memoryPacket{data: data, from: from}:
+		n.inFlight++
+	default:
+	}
+}
+
+// removes the transport and drops the packets still queued for it.
+func (n *MemoryNetwork) remove(t *MemoryTransport) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := newAddrKey(t.addr)
+	if n.transports[key] == t {
+		delete(n.transports, key)
+	}
+
+	for {
+		select {
+		case <-t.recvCh:
+			n.handledLocked(1)
+		default:
+			return
+		}
+	}
+}
+
+type memoryPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// A Transport on a MemoryNetwork.
+type MemoryTransport struct {
+	network   *MemoryNetwork
+	addr      *net.UDPAddr
+	recvCh    chan memoryPacket
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	reading   int32 // set atomically while the reader handles the last packet read
+}
+
+func (t *MemoryTransport) ReadFrom(b []byte) (int, net.Addr, error) {
+	if atomic.CompareAndSwapInt32(&t.reading, 1, 0) {
+		t.network.handled(1)
+	}
+
+	select {
+	case packet := <-t.recvCh:
+		atomic.StoreInt32(&t.reading, 1)
+		t.closedWhileReading()
+		return copy(b, packet.data), packet.from, nil
+	case <-t.closeCh:
+		return 0, nil, errors.New("memory transport has been closed")
+	}
+}
+
+func (t *MemoryTransport) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-t.closeCh:
+		return 0, errors.New("memory transport has been closed")
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("memory transport requires a *net.UDPAddr")
+	}
+
+	t.network.send(b, t.addr, to)
+	return len(b), nil
+}
+
+func (t *MemoryTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closeCh)
+		t.network.remove(t)
+		t.closedWhileReading()
+	})
+	return nil
+}
+
+// the reader may stop once the transport is closed, so the packet it is handling is counted
+// as handled by whichever of Close and ReadFrom sees both the close and the packet.
+func (t *MemoryTransport) closedWhileReading() {
+	select {
+	case <-t.closeCh:
+		if atomic.CompareAndSwapInt32(&t.reading, 1, 0) {
+			t.network.handled(1)
+		}
+	default:
+	}
+}
+
+func (t *MemoryTransport) LocalAddr() net.Addr {
+	return t.addr
+}
@@ -0,0 +1,133 @@
+package netcode
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	network := NewMemoryNetwork()
+	addr := net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+
+	serverTransport, err := network.Listen(&addr)
+	if err != nil {
+		t.Fatalf("error listening on memory network: %s\n", err)
+	}
+
+	if _, err := network.Listen(&addr); err == nil {
+		t.Fatalf("expected error listening on an address in use\n")
+	}
+
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.SetTransport(serverTransport)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	clients := make([]*Client, 2)
+	for i := range clients {
+		clientTransport, err := network.Listen(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 50000 + i})
+		if err != nil {
+			t.Fatalf("error listening on memory network: %s\n", err)
+		}
+
+		connectToken := NewConnectToken()
+		if err := connectToken.Generate(TEST_CLIENT_ID+uint64(i), []net.UDPAddr{addr}, VERSION_INFO, TEST_PROTOCOL_ID, TEST_CONNECT_TOKEN_EXPIRY, TEST_TIMEOUT_SECONDS, TEST_SEQUENCE_START, make([]byte, USER_DATA_BYTES), TEST_PRIVATE_KEY); err != nil {
+			t.Fatalf("error generating connect token: %s\n", err)
+		}
+
+		clients[i] = NewClient(connectToken)
+		clients[i].SetTransport(clientTransport)
+		if err := clients[i].Connect(); err != nil {
+			t.Fatalf("error connecting: %s\n", err)
+		}
+		defer clients[i].Close()
+	}
+
+	serverPayloads := 0
+	clientPayloads := make([]int, len(clients))
+	clientTime := float64(0)
+	for i := 0; i < 200; i += 1 {
+		serv.Update(serv.serverTime + 0.01)
+		for clientIndex := 0; clientIndex < serv.MaxClients(); clientIndex += 1 {
+			for {
+				data, _ := serv.RecvPayload(clientIndex)
+				if len(data) == 0 {
+					break
+				}
+				serverPayloads++
+			}
+		}
+		serv.SendPayloads([]byte{1, 2, 3, 4}, serv.serverTime)
+
+		done := serverPayloads >= 10
+		for j, client := range clients {
+			client.Update(clientTime)
+			if client.GetState() == StateConnected {
+				client.SendData([]byte{5, 6, 7, 8})
+			}
+
+			for {
+				data, _ := client.RecvData()
+				if data == nil {
+					break
+				}
+				clientPayloads[j]++
+			}
+			done = done && clientPayloads[j] >= 5
+		}
+
+		if done {
+			if serv.clientManager.ConnectedClientCount() != len(clients) {
+				t.Fatalf("expected %d clients connected over the memory network\n", len(clients))
+			}
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		clientTime += 0.01
+	}
+	t.Fatalf("expected payloads over the memory network, server got %d clients got %v\n", serverPayloads, clientPayloads)
+}
+
+func TestServerPacketConnTransport(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	addr := *packetConn.LocalAddr().(*net.UDPAddr)
+
+	serv := NewServer(&addr, TEST_PRIVATE_KEY, TEST_PROTOCOL_ID, 4)
+	serv.SetTransport(packetConn)
+	if err := serv.Init(); err != nil {
+		t.Fatalf("error initializing server: %s\n", err)
+	}
+
+	if err := serv.Listen(); err != nil {
+		t.Fatalf("error listening: %s\n", err)
+	}
+	defer serv.Stop()
+
+	client := NewClient(testGenerateConnectToken([]net.UDPAddr{addr}, TEST_PRIVATE_KEY, t))
+	if err := client.Connect(); err != nil {
+		t.Fatalf("error connecting: %s\n", err)
+	}
+	defer client.Close()
+
+	clientTime := float64(0)
+	for i := 0; i < 200 && client.GetState() > StateDisconnected && client.GetState() != StateConnected; i += 1 {
+		client.Update(clientTime)
+		time.Sleep(10 * time.Millisecond)
+		clientTime += 0.01
+		serv.Update(serv.serverTime + 0.01)
+	}
+
+	if client.GetState() != StateConnected {
+		t.Fatalf("expected client to connect to server on a net.PacketConn got: %s\n", clientStateMap[client.GetState()])
+	}
+}